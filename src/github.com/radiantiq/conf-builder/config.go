@@ -0,0 +1,132 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// validate checks conf for settings that can not work, so a bad file is
+// rejected before it replaces a running config.
+func (conf Conf) validate() error {
+	switch {
+	case conf.ConsulHostPort == "":
+		return errors.New("consulHostPort is not set")
+	case conf.ConsulConfigPath == "":
+		return errors.New("consulConfigPath is not set")
+	case conf.ConfigFile == "":
+		return errors.New("configFile is not set")
+	case conf.ReloadCmd == "":
+		return errors.New("haproxyReloadCmd is not set")
+	case conf.ServerSlots < 0:
+		return errors.New("serverSlots can not be negative")
+	case conf.StatsSocket != "" && conf.ServerSlots == 0:
+		return errors.New("statsSocket needs serverSlots to be set")
+	}
+	if _, err := conf.vipMatcher(); err != nil {
+		return err
+	}
+	if conf.ConsulTLSMinVersion != "" {
+		if _, ok := tlsVersions[conf.ConsulTLSMinVersion]; !ok {
+			return errors.New("unknown consulTLSMinVersion " + conf.ConsulTLSMinVersion + ", expected one of 1.0, 1.1, 1.2, 1.3")
+		}
+	}
+	if conf.TemplateFile != "" {
+		if _, err := os.Stat(conf.TemplateFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conf returns the config currently in use. Builds hold buildLock, so the
+// config can not change underneath a running build.
+func (w *Watcher) conf() Conf {
+	w.configLock.RLock()
+	defer w.configLock.RUnlock()
+	return w.Config
+}
+
+// setConfig swaps in a new config and consul client once any running build
+// has finished. Blocking queries in flight are abandoned so the watches pick
+// up the new consul settings, starting over from index 0 when they point
+// somewhere else.
+func (w *Watcher) setConfig(conf Conf, client *http.Client) {
+	w.buildLock.Lock()
+	defer w.buildLock.Unlock()
+	w.configLock.Lock()
+	old := w.Config
+	w.Config = conf
+	w.Client = client
+	if old.ConsulHostPort != conf.ConsulHostPort || old.ConsulConfigPath != conf.ConsulConfigPath {
+		atomic.StoreUint64(&w.Index, 0)
+		atomic.StoreUint64(&w.KVIndex, 0)
+	}
+	if w.reloaded != nil {
+		close(w.reloaded)
+	}
+	w.reloaded = make(chan struct{})
+	w.configLock.Unlock()
+}
+
+// queryContext derives the context for a single blocking query from ctx. It
+// is also cancelled when the config is swapped by setConfig.
+func (w *Watcher) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	w.configLock.Lock()
+	if w.reloaded == nil {
+		w.reloaded = make(chan struct{})
+	}
+	reloaded := w.reloaded
+	w.configLock.Unlock()
+
+	qctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-reloaded:
+			cancel()
+		case <-qctx.Done():
+		}
+	}()
+	return qctx, cancel
+}
+
+// reloadConfig re-reads the config file at path and, if it is valid, swaps
+// it in and rebuilds right away. An error means the file was rejected and
+// the running config kept; a failed rebuild is reported and retried by the
+// build loop like any other.
+func (w *Watcher) reloadConfig(path string) error {
+	conf, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	client, err := newConsulClient(*conf)
+	if err != nil {
+		return err
+	}
+	w.setConfig(*conf, client)
+	log.Println("reloaded config from ", path)
+	if err := w.rebuild(); err != nil {
+		w.reportError(err)
+		w.requestBuild()
+	}
+	return nil
+}
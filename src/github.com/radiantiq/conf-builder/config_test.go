@@ -0,0 +1,113 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConf(t *testing.T, dir, body string) string {
+	path := filepath.Join(dir, "conf.json")
+	if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := map[string]string{
+		"missing consul":   `{"haproxyReloadCmd": "true", "consulConfigPath": "/apps/haproxy", "configFile": "/tmp/haproxy.cfg"}`,
+		"missing reload":   `{"consulHostPort": "http://127.0.0.1:12424", "consulConfigPath": "/apps/haproxy", "configFile": "/tmp/haproxy.cfg"}`,
+		"socket, no slots": `{"haproxyReloadCmd": "true", "consulHostPort": "http://127.0.0.1:12424", "consulConfigPath": "/apps/haproxy", "configFile": "/tmp/haproxy.cfg", "statsSocket": "/tmp/haproxy.sock"}`,
+		"tls version":      `{"haproxyReloadCmd": "true", "consulHostPort": "http://127.0.0.1:12424", "consulConfigPath": "/apps/haproxy", "configFile": "/tmp/haproxy.cfg", "consulTLSMinVersion": "2.0"}`,
+		"missing template": `{"haproxyReloadCmd": "true", "consulHostPort": "http://127.0.0.1:12424", "consulConfigPath": "/apps/haproxy", "configFile": "/tmp/haproxy.cfg", "templateFile": "` + filepath.Join(dir, "nope.tmpl") + `"}`,
+		"not json":         `{"haproxyReloadCmd": `,
+	}
+	for name, body := range invalid {
+		if _, err := loadConfig(writeConf(t, dir, body)); err == nil {
+			t.Errorf("TestLoadConfigValidation accepted an invalid config: %s", name)
+		}
+	}
+
+	conf, err := loadConfig(writeConf(t, dir, `{"haproxyReloadCmd": "true", "consulHostPort": "http://127.0.0.1:12424", "consulConfigPath": "/apps/haproxy", "configFile": "/tmp/haproxy.cfg"}`))
+	if err != nil {
+		t.Fatalf("TestLoadConfigValidation rejected a valid config: %v", err)
+	}
+	if conf.ValidateCmd != defaultValidateCmd || conf.ShutdownTimeout.Duration != defaultShutdownTimeout {
+		t.Errorf("TestLoadConfigValidation defaults were not applied: %+v", conf)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "haproxy.cfg")
+	mockConf := Conf{ReloadCmd: "true", ValidateCmd: "none", ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy", ConfigFile: configFile}
+	mockWatcher := &Watcher{Index: 115780, KVIndex: 115762, Config: mockConf, ErrorChan: make(chan error, 10)}
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+
+	// a blocking query in flight is abandoned when the config is swapped
+	qctx, cancel := mockWatcher.queryContext(context.Background())
+	defer cancel()
+
+	// an invalid file keeps the running config
+	path := writeConf(t, dir, `{"haproxyReloadCmd": "true", "vips": ["test"], "consulConfigPath": "/apps/haproxy", "configFile": "`+configFile+`"}`)
+	if err := mockWatcher.reloadConfig(path); err == nil {
+		t.Fatal("TestReloadConfig accepted a config without consulHostPort")
+	}
+	if len(mockWatcher.conf().VIPs) != 0 || qctx.Err() != nil {
+		t.Fatalf("TestReloadConfig swapped in a rejected config: %+v", mockWatcher.conf())
+	}
+
+	// a new VIP is picked up and built right away
+	path = writeConf(t, dir, `{"haproxyReloadCmd": "true", "validateCmd": "none", "vips": ["test"], "consulHostPort": "http://127.0.0.1:12424", "consulConfigPath": "/apps/haproxy", "configFile": "`+configFile+`"}`)
+	if err := mockWatcher.reloadConfig(path); err != nil {
+		t.Fatalf("TestReloadConfig rejected a valid config: %v", err)
+	}
+	if qctx.Err() == nil {
+		t.Errorf("TestReloadConfig did not abandon the blocking query in flight")
+	}
+	written, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(written), "backend test-backend") {
+		t.Errorf("TestReloadConfig did not rebuild with the new VIP:\n%s", written)
+	}
+	if mockWatcher.Index != 115780 {
+		t.Errorf("TestReloadConfig reset the watch index although consul did not change")
+	}
+}
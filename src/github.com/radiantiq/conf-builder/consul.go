@@ -0,0 +1,199 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsulForbiddenError is returned when consul rejects a request with a 403,
+// which almost always means the ACL token is missing or lacks permissions.
+type ConsulForbiddenError struct {
+	Path string
+}
+
+func (e *ConsulForbiddenError) Error() string {
+	return "consul denied access to " + e.Path + " (403), check consulToken/consulTokenFile"
+}
+
+// tokenSource hands out the consul ACL token, re-reading the token file
+// whenever its modification time changes.
+type tokenSource struct {
+	sync.Mutex
+	token   string
+	modTime time.Time
+}
+
+func (ts *tokenSource) get(conf Conf) string {
+	if conf.ConsulTokenFile == "" {
+		return conf.ConsulToken
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	info, err := os.Stat(conf.ConsulTokenFile)
+	if err != nil {
+		log.Println("unable to stat consul token file: ", err)
+		return ts.token
+	}
+	if info.ModTime().Equal(ts.modTime) {
+		return ts.token
+	}
+	token, err := ioutil.ReadFile(conf.ConsulTokenFile)
+	if err != nil {
+		log.Println("unable to read consul token file: ", err)
+		return ts.token
+	}
+	log.Println("loaded consul token from ", conf.ConsulTokenFile)
+	ts.token = strings.TrimSpace(string(token))
+	ts.modTime = info.ModTime()
+	return ts.token
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newConsulClient builds the http.Client shared by every consul request from
+// the TLS settings in conf. Server certificates are always verified, against
+// ConsulCAFile when it is set and the system roots otherwise.
+func newConsulClient(conf Conf) (*http.Client, error) {
+	minVersion := "1.2"
+	if conf.ConsulTLSMinVersion != "" {
+		minVersion = conf.ConsulTLSMinVersion
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, errors.New("unknown consulTLSMinVersion " + minVersion + ", expected one of 1.0, 1.1, 1.2, 1.3")
+	}
+	tlsConfig := &tls.Config{MinVersion: version, ServerName: conf.ConsulServerName}
+
+	if conf.ConsulCAFile != "" {
+		caCerts, err := ioutil.ReadFile(conf.ConsulCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCerts) {
+			return nil, errors.New("no certificates found in " + conf.ConsulCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.ConsulCertFile != "" || conf.ConsulKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ConsulCertFile, conf.ConsulKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// client returns the shared consul client, falling back to the default
+// client when none was configured.
+func (w *Watcher) client() *http.Client {
+	w.configLock.RLock()
+	defer w.configLock.RUnlock()
+	if w.Client != nil {
+		return w.Client
+	}
+	return http.DefaultClient
+}
+
+// defaultConsulTimeout bounds the requests a build makes to consul when
+// consulTimeout is not set.
+const defaultConsulTimeout = 10 * time.Second
+
+// cancelBody releases the request context of a response once its body has
+// been closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// consulGet issues a GET against path on the configured consul host with
+// the ACL token attached. A 403 is turned into a ConsulForbiddenError. The
+// request, including reading the body, is given up after consulTimeout so a
+// hung consul can not hold a build forever.
+func (w *Watcher) consulGet(path string) (*http.Response, error) {
+	timeout := w.conf().ConsulTimeout.Duration
+	if timeout <= 0 {
+		timeout = defaultConsulTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	res, err := w.consulGetContext(ctx, path)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// consulGetContext is consulGet for requests, such as blocking queries,
+// that have to be abandoned when ctx is cancelled.
+func (w *Watcher) consulGetContext(ctx context.Context, path string) (*http.Response, error) {
+	conf := w.conf()
+	req, err := http.NewRequestWithContext(ctx, "GET", conf.ConsulHostPort+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := w.tokens.get(conf); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	endpoint := consulEndpoint(path)
+	start := time.Now()
+	res, err := w.client().Do(req)
+	metrics.consulRequestDuration.since(endpoint, start)
+	if err != nil {
+		metrics.consulRequestErrors.inc(endpoint)
+		return nil, err
+	}
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusNotFound {
+		metrics.consulRequestErrors.inc(endpoint)
+	}
+	if res.StatusCode == http.StatusForbidden {
+		res.Body.Close()
+		return nil, &ConsulForbiddenError{Path: path}
+	}
+	return res, nil
+}
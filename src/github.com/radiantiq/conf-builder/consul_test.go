@@ -0,0 +1,155 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func buildACLServer(token string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Permission denied"))
+			return
+		}
+		w.Header().Add("X-Consul-Index", "42")
+		writeHeaders(w, 200)
+		w.Write([]byte(`[]`))
+	}))
+}
+
+func TestConsulToken(t *testing.T) {
+	s := buildACLServer("secret")
+	defer s.Close()
+
+	mockConf := Conf{ConsulHostPort: s.URL, ConsulConfigPath: "/apps/haproxy", ConsulToken: "secret"}
+	mockWatcher := Watcher{Config: mockConf}
+	if _, err := mockWatcher.fetchIndex(context.Background(), "/v1/catalog/services", 0); err != nil {
+		t.Errorf("TestConsulToken returned an error with a valid token: %v", err)
+	}
+
+	mockWatcher.Config.ConsulToken = "wrong"
+	_, err := mockWatcher.getKVTree()
+	if _, ok := err.(*ConsulForbiddenError); !ok {
+		t.Errorf("TestConsulToken expected a ConsulForbiddenError, got: %v", err)
+	}
+}
+
+func TestConsulTokenFile(t *testing.T) {
+	s := buildACLServer("second")
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mockConf := Conf{ConsulHostPort: s.URL, ConsulConfigPath: "/apps/haproxy", ConsulTokenFile: tokenFile}
+	mockWatcher := Watcher{Config: mockConf}
+	if _, err := mockWatcher.getKVTree(); err == nil {
+		t.Errorf("TestConsulTokenFile expected the first token to be rejected")
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time moves even on coarse filesystems
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(tokenFile, later, later)
+	if _, err := mockWatcher.getKVTree(); err != nil {
+		t.Errorf("TestConsulTokenFile did not pick up the new token: %v", err)
+	}
+}
+
+func TestConsulClientTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Consul-Index", "7")
+		writeHeaders(w, 200)
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the test server's certificate is not in the system roots
+	client, err := newConsulClient(Conf{})
+	if err != nil {
+		t.Fatalf("TestConsulClientTLS failed to build default client: %v", err)
+	}
+	mockWatcher := Watcher{Config: Conf{ConsulHostPort: s.URL}, Client: client}
+	if _, err := mockWatcher.fetchIndex(context.Background(), "/v1/catalog/services", 0); err == nil {
+		t.Errorf("TestConsulClientTLS expected an unverified certificate to be rejected")
+	}
+
+	client, err = newConsulClient(Conf{ConsulCAFile: caFile, ConsulServerName: "example.com"})
+	if err != nil {
+		t.Fatalf("TestConsulClientTLS failed to build client with CA: %v", err)
+	}
+	mockWatcher.Client = client
+	if _, err := mockWatcher.fetchIndex(context.Background(), "/v1/catalog/services", 0); err != nil {
+		t.Errorf("TestConsulClientTLS returned an error with a trusted CA: %v", err)
+	}
+
+	if _, err := newConsulClient(Conf{ConsulTLSMinVersion: "1.4"}); err == nil {
+		t.Errorf("TestConsulClientTLS expected an unknown TLS version to be rejected")
+	}
+	if _, err := newConsulClient(Conf{ConsulCAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Errorf("TestConsulClientTLS expected a missing CA file to be rejected")
+	}
+}
+
+func TestConsulTimeout(t *testing.T) {
+	// consul that accepts the request and never answers
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s.Close()
+	defer close(release)
+
+	mockConf := Conf{ConsulHostPort: s.URL, ConsulConfigPath: "/apps/haproxy", ConsulTimeout: Duration{100 * time.Millisecond}}
+	mockWatcher := Watcher{Config: mockConf}
+	start := time.Now()
+	if _, err := mockWatcher.getKVTree(); err == nil {
+		t.Errorf("TestConsulTimeout expected the hung request to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("TestConsulTimeout waited %v for a hung consul", elapsed)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// coalescer turns a burst of change notifications into a single build. A
+// build runs once no change has arrived for quiet, but never later than
+// maxDelay after the first change of the burst and never sooner than
+// minInterval after the previous build. Failed builds are retried after
+// retryDelay, unless retryable says the error will not go away by itself.
+type coalescer struct {
+	quiet       time.Duration
+	maxDelay    time.Duration
+	minInterval time.Duration
+	retryDelay  time.Duration
+	retryable   func(error) bool
+}
+
+// deadline works out when a burst that started at first and last changed at
+// last should be built, given builds are not allowed before notBefore.
+func (c coalescer) deadline(first, last, notBefore time.Time) time.Time {
+	at := last.Add(c.quiet)
+	if c.maxDelay > 0 && first.Add(c.maxDelay).Before(at) {
+		at = first.Add(c.maxDelay)
+	}
+	if notBefore.After(at) {
+		at = notBefore
+	}
+	return at
+}
+
+// run calls build for every burst read from trigger until stop is closed.
+// A build that is already running is allowed to finish. Errors from build
+// are handed to onError.
+func (c coalescer) run(stop <-chan struct{}, trigger <-chan struct{}, build func() error, onError func(error)) {
+	var pending bool
+	var first, last, notBefore time.Time
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	arm := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.NewTimer(time.Until(c.deadline(first, last, notBefore)))
+		timerC = timer.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-trigger:
+			now := time.Now()
+			if !pending {
+				pending = true
+				first = now
+			}
+			last = now
+			arm()
+		case <-timerC:
+			timerC = nil
+			pending = false
+			err := build()
+			now := time.Now()
+			notBefore = now.Add(c.minInterval)
+			if err != nil {
+				onError(err)
+				if c.retryable != nil && !c.retryable(err) {
+					// wait for the next change instead
+					continue
+				}
+				pending = true
+				first, last = now, now
+				if retry := now.Add(c.retryDelay); retry.After(notBefore) {
+					notBefore = retry
+				}
+				arm()
+			}
+		}
+	}
+}
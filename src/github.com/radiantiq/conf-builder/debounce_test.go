@@ -0,0 +1,131 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runCoalescer starts c with build and returns the trigger and a func that
+// stops the loop.
+func runCoalescer(c coalescer, build func() error) (chan struct{}, func()) {
+	stop := make(chan struct{})
+	trigger := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		c.run(stop, trigger, build, func(error) {})
+		close(done)
+	}()
+	return trigger, func() {
+		close(stop)
+		<-done
+	}
+}
+
+func TestCoalescerQuietPeriod(t *testing.T) {
+	var builds int32
+	c := coalescer{quiet: 100 * time.Millisecond, maxDelay: 5 * time.Second}
+	trigger, stop := runCoalescer(c, func() error {
+		atomic.AddInt32(&builds, 1)
+		return nil
+	})
+	defer stop()
+
+	// a burst of changes well inside the quiet period
+	for i := 0; i < 10; i++ {
+		trigger <- struct{}{}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&builds); n != 0 {
+		t.Errorf("TestCoalescerQuietPeriod built %d times during the burst", n)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&builds); n != 1 {
+		t.Errorf("TestCoalescerQuietPeriod built %d times, should be 1", n)
+	}
+}
+
+func TestCoalescerMaxDelay(t *testing.T) {
+	var builds int32
+	c := coalescer{quiet: 100 * time.Millisecond, maxDelay: 150 * time.Millisecond}
+	trigger, stop := runCoalescer(c, func() error {
+		atomic.AddInt32(&builds, 1)
+		return nil
+	})
+	defer stop()
+
+	// changes never stop for long enough to satisfy the quiet period
+	for i := 0; i < 25; i++ {
+		trigger <- struct{}{}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&builds); n < 2 {
+		t.Errorf("TestCoalescerMaxDelay built %d times, should be at least 2", n)
+	}
+}
+
+func TestCoalescerMinIntervalAndRetry(t *testing.T) {
+	var builds int32
+	c := coalescer{minInterval: 200 * time.Millisecond, retryDelay: 50 * time.Millisecond}
+	trigger, stop := runCoalescer(c, func() error {
+		if atomic.AddInt32(&builds, 1) == 1 {
+			return errors.New("first build fails")
+		}
+		return nil
+	})
+	defer stop()
+
+	trigger <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&builds); n != 1 {
+		t.Fatalf("TestCoalescerMinIntervalAndRetry built %d times, should be 1", n)
+	}
+	// the retry has to wait out minInterval rather than retryDelay
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&builds); n != 1 {
+		t.Errorf("TestCoalescerMinIntervalAndRetry retried before minInterval")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&builds); n != 2 {
+		t.Errorf("TestCoalescerMinIntervalAndRetry built %d times, should be 2", n)
+	}
+}
+
+func TestCoalescerNoRetry(t *testing.T) {
+	var builds int32
+	c := coalescer{retryDelay: 20 * time.Millisecond, retryable: retryableBuildError}
+	trigger, stop := runCoalescer(c, func() error {
+		atomic.AddInt32(&builds, 1)
+		return &ValidationError{Cmd: "haproxy -c", Err: errors.New("exit status 1")}
+	})
+	defer stop()
+
+	trigger <- struct{}{}
+	time.Sleep(150 * time.Millisecond)
+	if n := atomic.LoadInt32(&builds); n != 1 {
+		t.Errorf("TestCoalescerNoRetry built %d times, a rejected config should not be retried", n)
+	}
+	// the next change builds again
+	trigger <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&builds); n != 2 {
+		t.Errorf("TestCoalescerNoRetry built %d times after a change, should be 2", n)
+	}
+}
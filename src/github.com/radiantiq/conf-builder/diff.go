@@ -0,0 +1,293 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// defaultDiffContext is the number of unchanged lines shown around each
+// change, as with diff -u.
+const defaultDiffContext = 3
+
+// diffOp is one line of an edit script: ' ' kept, '-' removed or '+' added.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitLines splits text after each newline. Only the last line can lack
+// its newline.
+func splitLines(text []byte) []string {
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// maxDiffEdits bounds the edit distance the diff searches for. Past it the
+// changed region is shown as one block of removals followed by additions,
+// which keeps memory at O(maxDiffEdits^2) however different the configs are.
+const maxDiffEdits = 1000
+
+// diffLines returns the shortest edit script from a to b, using Myers'
+// O(ND) algorithm on whatever is left once the common prefix and suffix are
+// stripped.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, diffOp{' ', a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	middle := myers(middleA, middleB, maxDiffEdits)
+	if middle == nil {
+		middle = replaceAll(middleA, middleB)
+	}
+	ops = append(ops, middle...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// replaceAll removes every line of a and adds every line of b.
+func replaceAll(a, b []string) []diffOp {
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a {
+		ops = append(ops, diffOp{'-', line})
+	}
+	for _, line := range b {
+		ops = append(ops, diffOp{'+', line})
+	}
+	return ops
+}
+
+// myers returns the shortest edit script from a to b, or nil when it takes
+// more than maxEdits insertions and deletions.
+func myers(a, b []string, maxEdits int) []diffOp {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return replaceAll(a, b)
+	}
+	total := n + m
+	offset := total + 1
+	v := make([]int, 2*total+3)
+	// trace[d] holds v[-d..d] as it was before round d, which is all the
+	// walk back below reads
+	var trace [][]int
+search:
+	for d := 0; ; d++ {
+		if d > maxEdits {
+			return nil
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// walk back from the end to recover the path, in reverse
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		// round d's window starts at k = -d
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x--
+		y--
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// hunkRange formats one side of a hunk header the way diff -u does.
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	if count == 0 {
+		// an empty range names the line before it
+		start--
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// unifiedDiff returns the unified diff from a to b with context lines of
+// context around each change, or an empty string when they match.
+func unifiedDiff(aName, bName string, a, b []byte, context int) string {
+	if context < 0 {
+		context = 0
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+	var changes []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	// line numbers in a and b at the start of ops[i]
+	aLine, bLine, i := 1, 1, 0
+	advance := func(to int) {
+		for ; i < to; i++ {
+			if ops[i].kind != '+' {
+				aLine++
+			}
+			if ops[i].kind != '-' {
+				bLine++
+			}
+		}
+	}
+	for c := 0; c < len(changes); {
+		// changes separated by no more than twice the context share a hunk
+		last := c
+		for last+1 < len(changes) && changes[last+1]-changes[last]-1 <= 2*context {
+			last++
+		}
+		start := changes[c] - context
+		if start < 0 {
+			start = 0
+		}
+		end := changes[last] + context + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		advance(start)
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLine, aCount), hunkRange(bLine, bCount))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		c = last + 1
+	}
+	return out.String()
+}
+
+// diffConfig returns the unified diff from the file at oldPath to newData,
+// or an empty string when they match. A missing oldPath diffs against
+// nothing.
+func diffConfig(oldPath string, newData []byte, context int) (string, error) {
+	current, err := ioutil.ReadFile(oldPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return unifiedDiff(oldPath, "(new)", current, newData, context), nil
+}
+
+// diffLineCount counts the added and removed lines in a unified diff.
+func diffLineCount(diff string) int {
+	count := 0
+	for i, line := range strings.Split(diff, "\n") {
+		// skip the ---/+++ file header
+		if i < 2 {
+			continue
+		}
+		if strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			count++
+		}
+	}
+	return count
+}
+
+// dryRunConfig stands in for writing and applying a build in dry-run mode.
+// The diff from configFile to the build is logged and its size recorded as
+// the pending diff.
+func (w *Watcher) dryRunConfig() error {
+	conf := w.conf()
+	diff, err := diffConfig(conf.ConfigFile, confText.Bytes(), conf.DiffContext)
+	if err != nil {
+		return err
+	}
+	lines := diffLineCount(diff)
+	w.status.recordPendingDiff(diff, lines)
+	metrics.pendingDiffLines.set("", float64(lines))
+	if diff == "" {
+		log.Println("dry run: config unchanged")
+		return nil
+	}
+	log.Printf("dry run: not applying %d changed lines:\n%s", lines, diff)
+	return nil
+}
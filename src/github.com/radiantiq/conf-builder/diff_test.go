@@ -0,0 +1,184 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	old := "global\ndefaults\nfrontend a\n    bind :80\nbackend a-backend\n    server a1 10.0.0.1:80 check\n    server a2 10.0.0.2:80 check\nbackend b-backend\n    server b1 10.0.1.1:80 check\n"
+	cases := []struct {
+		name    string
+		a, b    string
+		context int
+		diff    string
+	}{
+		{"unchanged", old, old, 3, ""},
+		{"server swapped", old, strings.Replace(old, "a2 10.0.0.2", "a3 10.0.0.3", 1), 1, `--- old
++++ new
+@@ -6,3 +6,3 @@
+     server a1 10.0.0.1:80 check
+-    server a2 10.0.0.2:80 check
++    server a3 10.0.0.3:80 check
+ backend b-backend
+`},
+		{"two hunks", old, strings.Replace(strings.Replace(old, "global", "global\n    maxconn 100", 1), "b1 10.0.1.1", "b1 10.0.1.9", 1), 1, `--- old
++++ new
+@@ -1,2 +1,3 @@
+ global
++    maxconn 100
+ defaults
+@@ -8,2 +9,2 @@
+ backend b-backend
+-    server b1 10.0.1.1:80 check
++    server b1 10.0.1.9:80 check
+`},
+		{"from nothing", "", "global\ndefaults\n", 3, `--- old
++++ new
+@@ -0,0 +1,2 @@
++global
++defaults
+`},
+		{"missing newline", "global\ndefaults", "global\ndefaults\n", 0, `--- old
++++ new
+@@ -2 +2 @@
+-defaults
+\ No newline at end of file
++defaults
+`},
+	}
+	for _, c := range cases {
+		if diff := unifiedDiff("old", "new", []byte(c.a), []byte(c.b), c.context); diff != c.diff {
+			t.Errorf("TestUnifiedDiff %s got\n%s\nexpected\n%s", c.name, diff, c.diff)
+		}
+	}
+
+	// the edit script has to reproduce both sides
+	a := splitLines([]byte(old))
+	b := splitLines([]byte("global\nfrontend b\nbackend a-backend\n    server a9 10.0.0.9:80 check\n    server a1 10.0.0.1:80 check\n"))
+	if !reproduces(diffLines(a, b), a, b) {
+		t.Errorf("TestUnifiedDiff edit script does not reproduce its inputs")
+	}
+}
+
+// reproduces reports whether ops turn a into b.
+func reproduces(ops []diffOp, a, b []string) bool {
+	var gotA, gotB []string
+	for _, op := range ops {
+		if op.kind != '+' {
+			gotA = append(gotA, op.line)
+		}
+		if op.kind != '-' {
+			gotB = append(gotB, op.line)
+		}
+	}
+	return strings.Join(gotA, "") == strings.Join(a, "") && strings.Join(gotB, "") == strings.Join(b, "")
+}
+
+func TestUnifiedDiffLargeConfigs(t *testing.T) {
+	var config, other strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&config, "    server srv%d 10.0.%d.%d:80 check\n", i, i/256, i%256)
+		fmt.Fprintf(&other, "    server srv%d 10.1.%d.%d:80 check\n", i, i/256, i%256)
+	}
+	a, b := splitLines([]byte(config.String())), splitLines([]byte(other.String()))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	// the first apply diffs against a missing configFile
+	fromNothing := diffLines(nil, a)
+	// every line changed, far past maxDiffEdits
+	replaced := diffLines(a, b)
+	runtime.ReadMemStats(&after)
+
+	if len(fromNothing) != len(a) || !reproduces(fromNothing, nil, a) {
+		t.Errorf("TestUnifiedDiffLargeConfigs diff from nothing is wrong")
+	}
+	if !reproduces(replaced, a, b) {
+		t.Errorf("TestUnifiedDiffLargeConfigs replace-all diff does not reproduce its inputs")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Errorf("TestUnifiedDiffLargeConfigs allocated %d MB", allocated>>20)
+	}
+}
+
+func TestDiffLineCount(t *testing.T) {
+	diff := `--- a/haproxy.cfg
++++ b/haproxy.cfg
+@@ -1,3 +1,3 @@
+ backend test-backend
+-    server a 10.0.0.1:80 check
++    server b 10.0.0.2:80 check
++    server c 10.0.0.3:80 check
+`
+	if n := diffLineCount(diff); n != 3 {
+		t.Errorf("TestDiffLineCount counted %d lines, expected 3", n)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "haproxy.cfg")
+	if err := ioutil.WriteFile(configFile, []byte("old config\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(dir, "reloaded")
+	mockConf := Conf{ReloadCmd: "touch " + marker, VIPs: []string{"test"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy", ConfigFile: configFile, DryRun: true}
+	mockWatcher := &Watcher{Config: mockConf, ErrorChan: make(chan error, 10)}
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+
+	if err := mockWatcher.forceRebuild(); err != nil {
+		t.Fatalf("TestDryRun returned an error: %v", err)
+	}
+	assertFile(t, configFile, "old config\n")
+	for _, untouched := range []string{configFile + ".new", marker} {
+		if _, err := os.Stat(untouched); !os.IsNotExist(err) {
+			t.Errorf("TestDryRun should not have created %s", untouched)
+		}
+	}
+	status := mockWatcher.Status()
+	if !status.DryRun || status.PendingDiffLines == 0 || !strings.Contains(status.PendingDiff, "+backend test-backend") {
+		t.Errorf("TestDryRun status does not show the pending diff: %+v", status)
+	}
+
+	// once the file matches there is nothing pending
+	if err := ioutil.WriteFile(configFile, confText.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mockWatcher.rebuild(); err != nil {
+		t.Fatalf("TestDryRun returned an error: %v", err)
+	}
+	if status := mockWatcher.Status(); status.PendingDiffLines != 0 {
+		t.Errorf("TestDryRun still has %d pending lines for a matching config", status.PendingDiffLines)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyTimeFormat sorts lexically in time order.
+const historyTimeFormat = "20060102T150405.000Z"
+
+// HistoryEntry is a config that was applied at Time, produced by the
+// catalog Index and KVIndex.
+type HistoryEntry struct {
+	Name    string
+	Path    string
+	Time    time.Time
+	Index   uint64
+	KVIndex uint64
+}
+
+// diffPath is where the diff applied with the entry is kept, if any.
+func (entry HistoryEntry) diffPath() string {
+	return strings.TrimSuffix(entry.Path, ".cfg") + ".diff"
+}
+
+// parseHistoryName splits <time>-<index>-<kvIndex>.cfg back into an entry.
+func parseHistoryName(dir, file string) (HistoryEntry, error) {
+	name := strings.TrimSuffix(file, ".cfg")
+	parts := strings.Split(name, "-")
+	if len(parts) != 3 || !strings.HasSuffix(file, ".cfg") {
+		return HistoryEntry{}, errors.New("not a history file: " + file)
+	}
+	ts, err := time.Parse(historyTimeFormat, parts[0])
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	index, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	kvIndex, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	return HistoryEntry{Name: name, Path: filepath.Join(dir, file), Time: ts, Index: index, KVIndex: kvIndex}, nil
+}
+
+// listHistory returns the archived configs in dir, oldest first.
+func listHistory(dir string) ([]HistoryEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []HistoryEntry
+	for _, file := range files {
+		entry, err := parseHistoryName(dir, file.Name())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// findHistory looks up an entry by name, with or without the .cfg suffix.
+func findHistory(dir, name string) (HistoryEntry, error) {
+	entries, err := listHistory(dir)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	name = strings.TrimSuffix(name, ".cfg")
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, nil
+		}
+	}
+	return HistoryEntry{}, errors.New("no history entry named " + name)
+}
+
+// archiveConfig stores an applied config, and the diff that was applied
+// with it, in historyDir and prunes the oldest entries beyond historyLimit.
+// It is a no-op without a historyDir.
+func (w *Watcher) archiveConfig(data []byte, diff string, index, kvIndex uint64) error {
+	conf := w.conf()
+	if conf.HistoryDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(conf.HistoryDir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%d-%d", time.Now().UTC().Format(historyTimeFormat), index, kvIndex)
+	if diff != "" {
+		if err := writeFileSync(filepath.Join(conf.HistoryDir, name+".diff"), []byte(diff), 0644); err != nil {
+			return err
+		}
+	}
+	if err := writeFileSync(filepath.Join(conf.HistoryDir, name+".cfg"), data, 0644); err != nil {
+		return err
+	}
+	log.Println("archived applied config as ", name)
+
+	if conf.HistoryLimit <= 0 {
+		return nil
+	}
+	entries, err := listHistory(conf.HistoryDir)
+	if err != nil {
+		return err
+	}
+	for len(entries) > conf.HistoryLimit {
+		if err := os.Remove(entries[0].Path); err != nil {
+			return err
+		}
+		if err := os.Remove(entries[0].diffPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		entries = entries[1:]
+	}
+	return nil
+}
+
+const historyUsage = `usage: conf-builder [-c conf.json] history <command>
+
+commands:
+  list                 list archived configs, oldest first
+  show <name>          print an archived config
+  changes <name>       print the diff that was applied with an archived config
+  diff <name> [other]  diff an archived config against another one or the current config
+  restore <name>       validate, install and reload an archived config`
+
+// runHistory implements the history subcommand.
+func runHistory(conf Conf, args []string) error {
+	if conf.HistoryDir == "" {
+		return errors.New("historyDir is not set in the config file")
+	}
+	if len(args) == 0 {
+		return errors.New(historyUsage)
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		entries, err := listHistory(conf.HistoryDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\tindex=%d\tkvIndex=%d\n", entry.Name, entry.Time.Local().Format(time.RFC3339), entry.Index, entry.KVIndex)
+		}
+		return nil
+	case args[0] == "show" && len(args) == 2:
+		entry, err := findHistory(conf.HistoryDir, args[1])
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(entry.Path)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	case args[0] == "diff" && (len(args) == 2 || len(args) == 3):
+		entry, err := findHistory(conf.HistoryDir, args[1])
+		if err != nil {
+			return err
+		}
+		other := conf.ConfigFile
+		if len(args) == 3 {
+			otherEntry, err := findHistory(conf.HistoryDir, args[2])
+			if err != nil {
+				return err
+			}
+			other = otherEntry.Path
+		}
+		old, err := ioutil.ReadFile(entry.Path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(other)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(os.Stdout, unifiedDiff(entry.Path, other, old, data, conf.DiffContext))
+		return err
+	case args[0] == "changes" && len(args) == 2:
+		entry, err := findHistory(conf.HistoryDir, args[1])
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(entry.diffPath())
+		if os.IsNotExist(err) {
+			return errors.New("no diff was recorded for " + entry.Name)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	case args[0] == "restore" && len(args) == 2:
+		entry, err := findHistory(conf.HistoryDir, args[1])
+		if err != nil {
+			return err
+		}
+		return restoreHistory(conf, entry)
+	}
+	return errors.New(historyUsage)
+}
+
+// restoreHistory puts an archived config back through the same validate,
+// install and reload path as a normal build.
+func restoreHistory(conf Conf, entry HistoryEntry) error {
+	data, err := ioutil.ReadFile(entry.Path)
+	if err != nil {
+		return err
+	}
+	w := &Watcher{Config: conf}
+	if err := writeFileSync(w.tempPath(), data, 0644); err != nil {
+		return err
+	}
+	if err := w.validateConfig(); err != nil {
+		os.Remove(w.tempPath())
+		return err
+	}
+	diff, err := diffConfig(conf.ConfigFile, data, conf.DiffContext)
+	if err != nil {
+		return err
+	}
+	if err := w.copyAndRestart(); err != nil {
+		return err
+	}
+	log.Printf("restored %s:\n%s", entry.Name, diff)
+	return w.archiveConfig(data, diff, entry.Index, entry.KVIndex)
+}
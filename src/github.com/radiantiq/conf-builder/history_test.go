@@ -0,0 +1,91 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyDir := filepath.Join(dir, "history")
+
+	mockConf := Conf{ConfigFile: filepath.Join(dir, "haproxy.cfg"), HistoryDir: historyDir, HistoryLimit: 2}
+	mockWatcher := Watcher{Config: mockConf}
+	for i := uint64(1); i <= 3; i++ {
+		if err := mockWatcher.archiveConfig([]byte{byte('0' + i)}, fmt.Sprintf("diff %d\n", i), 100+i, 200+i); err != nil {
+			t.Fatalf("TestArchiveConfig returned an error: %v", err)
+		}
+	}
+
+	entries, err := listHistory(historyDir)
+	if err != nil {
+		t.Fatalf("TestArchiveConfig unable to list history: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("TestArchiveConfig kept %d entries, should be 2", len(entries))
+	}
+	if entries[0].Index != 102 || entries[0].KVIndex != 202 || entries[1].Index != 103 {
+		t.Errorf("TestArchiveConfig kept the wrong entries: %+v", entries)
+	}
+	assertFile(t, entries[1].Path, "3")
+	assertFile(t, entries[1].diffPath(), "diff 3\n")
+	if files, _ := ioutil.ReadDir(historyDir); len(files) != 4 {
+		t.Errorf("TestArchiveConfig left %d files behind, should be 2 configs and 2 diffs", len(files))
+	}
+
+	found, err := findHistory(historyDir, entries[0].Name+".cfg")
+	if err != nil || found.Path != entries[0].Path {
+		t.Errorf("TestArchiveConfig unable to find %s: %v", entries[0].Name, err)
+	}
+}
+
+func TestRestoreHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "haproxy.cfg")
+	ioutil.WriteFile(configFile, []byte("current\n"), 0644)
+
+	mockConf := Conf{ConfigFile: configFile, ReloadCmd: "true", ValidateCmd: "grep -q old {file}", HistoryDir: filepath.Join(dir, "history")}
+	mockWatcher := Watcher{Config: mockConf}
+	mockWatcher.archiveConfig([]byte("old\n"), "", 5, 6)
+	entries, _ := listHistory(mockConf.HistoryDir)
+	if len(entries) != 1 {
+		t.Fatalf("TestRestoreHistory expected one entry, got %d", len(entries))
+	}
+
+	if err := runHistory(mockConf, []string{"restore", entries[0].Name}); err != nil {
+		t.Fatalf("TestRestoreHistory returned an error: %v", err)
+	}
+	assertFile(t, configFile, "old\n")
+	assertFile(t, mockWatcher.prevPath(), "current\n")
+
+	if err := runHistory(mockConf, []string{"restore"}); err == nil {
+		t.Errorf("TestRestoreHistory expected usage error without a name")
+	}
+}
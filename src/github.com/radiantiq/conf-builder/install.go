@@ -0,0 +1,110 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// tempPath is where a new config is staged. It sits next to ConfigFile so
+// the final rename never crosses a filesystem.
+func (w *Watcher) tempPath() string {
+	return w.conf().ConfigFile + ".new"
+}
+
+// prevPath holds the config haproxy was running before the last install.
+func (w *Watcher) prevPath() string {
+	return w.conf().ConfigFile + ".prev"
+}
+
+// writeFileSync writes data to path and fsyncs it before returning.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir fsyncs the directory holding path so a rename survives a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// replaceFile atomically swaps data in at path through a synced temp file.
+func replaceFile(temp, path string, data []byte) error {
+	if err := writeFileSync(temp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// installConfig keeps the running config as prevPath and atomically renames
+// the staged temp file over ConfigFile.
+func (w *Watcher) installConfig() error {
+	current, err := ioutil.ReadFile(w.conf().ConfigFile)
+	switch {
+	case err == nil:
+		if err := writeFileSync(w.prevPath(), current, 0644); err != nil {
+			log.Println("unable to save previous haproxy config ", err)
+			return err
+		}
+	case os.IsNotExist(err):
+		// first run, nothing to keep
+	default:
+		log.Println("unable to read current haproxy config ", err)
+		return err
+	}
+
+	if err := os.Rename(w.tempPath(), w.conf().ConfigFile); err != nil {
+		log.Println("unable to move new haproxy config into place ", err)
+		return err
+	}
+	return syncDir(w.conf().ConfigFile)
+}
+
+// rollbackConfig puts prevPath back in place of ConfigFile.
+func (w *Watcher) rollbackConfig() error {
+	prev, err := ioutil.ReadFile(w.prevPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("no previous haproxy config to roll back to")
+		}
+		return err
+	}
+	return replaceFile(w.tempPath(), w.conf().ConfigFile, prev)
+}
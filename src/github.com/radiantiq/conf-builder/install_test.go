@@ -0,0 +1,83 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyAndRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "haproxy.cfg")
+	ioutil.WriteFile(configFile, []byte("good 1\n"), 0644)
+
+	// the reload only succeeds while the installed config is "good"
+	mockConf := Conf{ConfigFile: configFile, ReloadCmd: "grep -q good " + configFile}
+	mockWatcher := Watcher{Index: 0, Config: mockConf}
+
+	ioutil.WriteFile(mockWatcher.tempPath(), []byte("good 2\n"), 0644)
+	if err := mockWatcher.copyAndRestart(); err != nil {
+		t.Errorf("TestCopyAndRestart returned an error: %v", err)
+	}
+	assertFile(t, configFile, "good 2\n")
+	assertFile(t, mockWatcher.prevPath(), "good 1\n")
+	if _, err := os.Stat(mockWatcher.tempPath()); !os.IsNotExist(err) {
+		t.Errorf("TestCopyAndRestart left the temp file behind")
+	}
+
+	ioutil.WriteFile(mockWatcher.tempPath(), []byte("bad 3\n"), 0644)
+	err = mockWatcher.copyAndRestart()
+	if err == nil || !strings.Contains(err.Error(), "previous config restored") {
+		t.Errorf("TestCopyAndRestart expected a rolled back reload, got: %v", err)
+	}
+	assertFile(t, configFile, "good 2\n")
+}
+
+func TestRollbackWithoutPrevious(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockConf := Conf{ConfigFile: filepath.Join(dir, "haproxy.cfg"), ReloadCmd: "false"}
+	mockWatcher := Watcher{Index: 0, Config: mockConf}
+	ioutil.WriteFile(mockWatcher.tempPath(), []byte("first\n"), 0644)
+	err = mockWatcher.copyAndRestart()
+	if err == nil || !strings.Contains(err.Error(), "rollback failed") {
+		t.Errorf("TestRollbackWithoutPrevious expected the rollback to fail, got: %v", err)
+	}
+}
+
+func assertFile(t *testing.T, path, want string) {
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("unable to read %s: %v", path, err)
+		return
+	}
+	if string(got) != want {
+		t.Errorf("%s is %q, should be %q", path, string(got), want)
+	}
+}
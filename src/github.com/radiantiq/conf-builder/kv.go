@@ -0,0 +1,65 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// KVTree is a snapshot of every key under ConsulConfigPath, keyed by the
+// path relative to it (e.g. "frontend/myApp/mode") with decoded values.
+type KVTree map[string]string
+
+// get returns the value stored at key or an empty string.
+func (t KVTree) get(key string) string {
+	return t[key]
+}
+
+// has reports whether key itself or anything below it exists.
+func (t KVTree) has(key string) bool {
+	if _, ok := t[key]; ok {
+		return true
+	}
+	prefix := key + "/"
+	for k := range t {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// children returns the sorted, de-duplicated names directly below prefix.
+func (t KVTree) children(prefix string) []string {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	seen := make(map[string]bool)
+	var names []string
+	for k := range t {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0]
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -18,49 +18,167 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
+	"time"
 )
 
 var configFile = flag.String("c", "conf.json", "config file location")
+
+var dryRun = flag.Bool("dry-run", false, "log config diffs instead of applying them, overrides dryRun in the config file")
+
+// defaultValidateCmd checks the generated config before it replaces the
+// running one.
+const defaultValidateCmd = "haproxy -c -f {file}"
+
+// defaultHistoryLimit is how many applied configs are kept in historyDir.
+const defaultHistoryLimit = 50
+
+// default reload coalescing, see Conf.ReloadDebounce
+const (
+	defaultReloadDebounce = 2 * time.Second
+	defaultReloadMaxDelay = 10 * time.Second
+)
+
+// defaultShutdownTimeout bounds how long a signal waits for a running
+// build/reload before the process exits anyway.
+const defaultShutdownTimeout = 30 * time.Second
+
 var config = &Conf{}
 
 var confText bytes.Buffer
 
+// loadConfig reads the config file at path and fills in defaults.
+func loadConfig(path string) (*Conf, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Conf{}
+	if err := json.Unmarshal(file, conf); err != nil {
+		return nil, err
+	}
+	if conf.ValidateCmd == "" {
+		conf.ValidateCmd = defaultValidateCmd
+	}
+	if conf.HistoryLimit == 0 {
+		conf.HistoryLimit = defaultHistoryLimit
+	}
+	if conf.ReloadDebounce.Duration == 0 {
+		conf.ReloadDebounce.Duration = defaultReloadDebounce
+	}
+	if conf.ReloadMaxDelay.Duration == 0 {
+		conf.ReloadMaxDelay.Duration = defaultReloadMaxDelay
+	}
+	if conf.VIPSelection == "" {
+		conf.VIPSelection = vipSelectionList
+	}
+	if conf.NodeName == "" {
+		if conf.NodeName, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.DiffContext == 0 {
+		conf.DiffContext = defaultDiffContext
+	}
+	if conf.ShutdownTimeout.Duration == 0 {
+		conf.ShutdownTimeout.Duration = defaultShutdownTimeout
+	}
+	if *dryRun {
+		conf.DryRun = true
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
 func main() {
 	flag.Parse()
-	file, err := ioutil.ReadFile(*configFile)
+	switch flag.Arg(0) {
+	case "":
+	case "history":
+		conf, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal("unable to load config file: ", err)
+		}
+		if err := runHistory(*conf, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "render":
+		if err := runRender(*configFile, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %q, expected history or render", flag.Arg(0))
+	}
+
+	var err error
+	config, err = loadConfig(*configFile)
 	if err != nil {
-		log.Panic("unable to read config file, exiting...")
+		log.Panic("unable to load config file, exiting... ", err)
 	}
-	config = &Conf{}
-	if err := json.Unmarshal(file, &config); err != nil {
-		log.Panic("unable to marshal config file, exiting...")
+
+	client, err := newConsulClient(*config)
+	if err != nil {
+		log.Panic("unable to set up consul client: ", err)
 	}
 
-	stopChan := make(chan bool)
-	doneChan := make(chan bool)
 	errChan := make(chan error, 10)
-	var wg sync.WaitGroup
-	watcher := Watcher{StopChan: stopChan, DoneChan: doneChan, ErrorChan: errChan, Waitgroup: wg, Index: 0, Config: *config}
+	watcher := &Watcher{ErrorChan: errChan, Index: 0, KVIndex: 0, Config: *config, Client: client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	doneChan := make(chan bool)
+	if config.ListenAddr != "" {
+		go func() {
+			if err := watcher.serveStatus(ctx, config.ListenAddr); err != nil {
+				log.Println("status server stopped: ", err)
+			}
+		}()
+	}
+	go func() {
+		watcher.Watch(ctx)
+		close(doneChan)
+	}()
 
-	go watcher.Watch()
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	var timeout <-chan time.Time
 	for {
 		select {
 		case err := <-errChan:
 			log.Println("Error: ", err)
 		case s := <-signalChan:
-			log.Printf("captured %v exiting...", s)
-			close(doneChan)
+			if s == syscall.SIGHUP {
+				log.Println("captured SIGHUP, reloading ", *configFile)
+				go func() {
+					if err := watcher.reloadConfig(*configFile); err != nil {
+						log.Println("new config rejected, keeping the running one: ", err)
+					}
+				}()
+				continue
+			}
+			if timeout != nil {
+				log.Printf("captured %v again, exiting without waiting", s)
+				os.Exit(1)
+			}
+			shutdownTimeout := watcher.conf().ShutdownTimeout.Duration
+			log.Printf("captured %v, waiting up to %v for a running build to finish...", s, shutdownTimeout)
+			cancel()
+			timeout = time.After(shutdownTimeout)
+		case <-timeout:
+			log.Println("build still running after the shutdown timeout, exiting anyway")
+			os.Exit(1)
 		case <-doneChan:
+			log.Println("shut down cleanly")
 			os.Exit(0)
 		}
 	}
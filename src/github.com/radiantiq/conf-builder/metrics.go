@@ -0,0 +1,255 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tiny implementation of the prometheus text exposition format, enough for
+// a handful of counters, gauges and histograms with at most one label.
+
+// metricVec holds the values of one metric family keyed by label value.
+type metricVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	label  string
+	values map[string]float64
+}
+
+func newMetricVec(kind, name, help, label string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, label: label, values: make(map[string]float64)}
+}
+
+func newCounter(name, help, label string) *metricVec {
+	return newMetricVec("counter", name, help, label)
+}
+
+func newGauge(name, help, label string) *metricVec {
+	return newMetricVec("gauge", name, help, label)
+}
+
+func (m *metricVec) add(labelValue string, v float64) {
+	m.Lock()
+	m.values[labelValue] += v
+	m.Unlock()
+}
+
+func (m *metricVec) inc(labelValue string) {
+	m.add(labelValue, 1)
+}
+
+func (m *metricVec) set(labelValue string, v float64) {
+	m.Lock()
+	m.values[labelValue] = v
+	m.Unlock()
+}
+
+// reset drops every value, for gauges whose label values come and go.
+func (m *metricVec) reset() {
+	m.Lock()
+	m.values = make(map[string]float64)
+	m.Unlock()
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.label == "" {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.values[""]))
+		return
+	}
+	for _, lv := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", m.name, labelPair(m.label, lv), formatFloat(m.values[lv]))
+	}
+}
+
+// histogramVec is a histogram family keyed by label value.
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+func newHistogram(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+}
+
+func (h *histogramVec) observe(labelValue string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+	counts, ok := h.counts[labelValue]
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[labelValue] = counts
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			counts[i]++
+		}
+	}
+	h.sums[labelValue] += v
+	h.totals[labelValue]++
+}
+
+// since observes the seconds elapsed since start.
+func (h *histogramVec) since(labelValue string, start time.Time) {
+	h.observe(labelValue, time.Since(start).Seconds())
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labelValues := make([]string, 0, len(h.totals))
+	for lv := range h.totals {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		prefix := ""
+		if h.label != "" {
+			prefix = labelPair(h.label, lv) + ","
+		}
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatFloat(upper), h.counts[lv][i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, h.totals[lv])
+		labels := ""
+		if h.label != "" {
+			labels = "{" + labelPair(h.label, lv) + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(h.sums[lv]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, h.totals[lv])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPair(label, value string) string {
+	return label + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	// consul requests include blocking queries, hence the long tail
+	consulBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30, 60, 300, 600}
+	buildBuckets  = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// metrics are the process wide prometheus metrics served on /metrics.
+var metrics = struct {
+	consulRequestDuration *histogramVec
+	consulRequestErrors   *metricVec
+	buildDuration         *histogramVec
+	buildsSkipped         *metricVec
+	reloads               *metricVec
+	reloadFailures        *metricVec
+	reloadDuration        *histogramVec
+	vipsRendered          *metricVec
+	backendServers        *metricVec
+	watchedIndex          *metricVec
+	pendingDiffLines      *metricVec
+}{
+	consulRequestDuration: newHistogram("conf_builder_consul_request_duration_seconds", "Latency of consul requests, including blocking query waits.", "endpoint", consulBuckets),
+	consulRequestErrors:   newCounter("conf_builder_consul_request_errors_total", "Consul requests that failed or returned an error status.", "endpoint"),
+	buildDuration:         newHistogram("conf_builder_build_duration_seconds", "Time taken to build the config from consul.", "", buildBuckets),
+	buildsSkipped:         newCounter("conf_builder_builds_skipped_unchanged_total", "Builds that matched the running config and were not applied.", ""),
+	reloads:               newCounter("conf_builder_reloads_total", "HAProxy reloads attempted.", ""),
+	reloadFailures:        newCounter("conf_builder_reload_failures_total", "HAProxy reloads that failed.", ""),
+	reloadDuration:        newHistogram("conf_builder_reload_duration_seconds", "Time taken to install the config and reload HAProxy.", "", buildBuckets),
+	vipsRendered:          newGauge("conf_builder_vips_rendered", "VIPs rendered by the last build.", ""),
+	backendServers:        newGauge("conf_builder_backend_servers", "Active servers rendered per backend by the last build, empty slots excluded.", "backend"),
+	watchedIndex:          newGauge("conf_builder_watched_index", "Latest consul index seen per watch.", "watch"),
+	pendingDiffLines:      newGauge("conf_builder_dry_run_pending_diff_lines", "Changed lines a dry run is not applying.", ""),
+}
+
+// writeMetrics writes every metric in the text exposition format.
+func writeMetrics(w io.Writer) {
+	metrics.consulRequestDuration.writeTo(w)
+	metrics.consulRequestErrors.writeTo(w)
+	metrics.buildDuration.writeTo(w)
+	metrics.buildsSkipped.writeTo(w)
+	metrics.reloads.writeTo(w)
+	metrics.reloadFailures.writeTo(w)
+	metrics.reloadDuration.writeTo(w)
+	metrics.vipsRendered.writeTo(w)
+	metrics.backendServers.writeTo(w)
+	metrics.watchedIndex.writeTo(w)
+	metrics.pendingDiffLines.writeTo(w)
+}
+
+// activeServers counts the servers taking traffic, leaving out the disabled
+// placeholders rendered into free runtime slots.
+func activeServers(servers []Server) float64 {
+	n := 0
+	for _, s := range servers {
+		if s.active() {
+			n++
+		}
+	}
+	return float64(n)
+}
+
+// consulEndpoint turns a request path into a low cardinality label, e.g.
+// /v1/health/service/web?passing becomes health/service.
+func consulEndpoint(path string) string {
+	path = strings.SplitN(path, "?", 2)[0]
+	parts := strings.Split(strings.TrimPrefix(path, "/v1/"), "/")
+	if parts[0] == "kv" || len(parts) == 1 {
+		return parts[0]
+	}
+	return parts[0] + "/" + parts[1]
+}
@@ -0,0 +1,97 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistogramFormat(t *testing.T) {
+	h := newHistogram("test_seconds", "Test histogram.", "op", []float64{0.1, 1})
+	h.observe("read", 0.05)
+	h.observe("read", 0.5)
+	h.observe("read", 5)
+
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="read",le="0.1"} 1
+test_seconds_bucket{op="read",le="1"} 2
+test_seconds_bucket{op="read",le="+Inf"} 3
+test_seconds_sum{op="read"} 5.55
+test_seconds_count{op="read"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("TestHistogramFormat got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func TestConsulEndpoint(t *testing.T) {
+	cases := map[string]string{
+		"/v1/catalog/services?index=12":         "catalog/services",
+		"/v1/health/service/test?passing":       "health/service",
+		"/v1/kv/apps/haproxy?recurse&index=100": "kv",
+	}
+	for path, expected := range cases {
+		if endpoint := consulEndpoint(path); endpoint != expected {
+			t.Errorf("TestConsulEndpoint %s gave %s, expected %s", path, endpoint, expected)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockConf := Conf{ReloadCmd: "true", VIPs: []string{"test"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy", ConfigFile: filepath.Join(dir, "haproxy.cfg")}
+	mockWatcher := &Watcher{Config: mockConf, ErrorChan: make(chan error, 10)}
+	mux := mockWatcher.statusMux()
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+
+	if err := mockWatcher.forceRebuild(); err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	body := res.Body.String()
+	for _, line := range []string{
+		"# TYPE conf_builder_build_duration_seconds histogram",
+		`conf_builder_consul_request_duration_seconds_count{endpoint="health/service"}`,
+		`conf_builder_backend_servers{backend="test-backend"} 2`,
+		"conf_builder_vips_rendered 1",
+		"conf_builder_reloads_total",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("TestMetricsEndpoint /metrics is missing %q:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+)
+
+// renderConfig runs a single build against consul with conf and returns the
+// result. Nothing is written, validated or reloaded.
+func renderConfig(conf Conf) ([]byte, error) {
+	client, err := newConsulClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{Config: conf, Client: client}
+	confText.Reset()
+	w.pending = newRuntimeState()
+	if err := w.buildConfig(); err != nil {
+		return nil, err
+	}
+	return confText.Bytes(), nil
+}
+
+// runRender implements `conf-builder render [-c conf.json] [-node name]
+// [-o file]`, printing the config to stdout unless -o is given. -node
+// renders the config as the named HAProxy host would see it, since VIPs
+// pinned with vip/<name>/nodes are otherwise matched against the host
+// render runs on.
+func runRender(configPath string, args []string) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	path := flags.String("c", configPath, "config file location")
+	node := flags.String("node", "", "render for this nodeName instead of the one in the config")
+	out := flags.String("o", "", "write the config to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	conf, err := loadConfig(*path)
+	if err != nil {
+		return err
+	}
+	if *node != "" {
+		conf.NodeName = *node
+	}
+	data, err := renderConfig(*conf)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*out, data, 0644)
+}
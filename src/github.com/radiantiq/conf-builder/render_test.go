@@ -0,0 +1,78 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "haproxy.cfg")
+	marker := filepath.Join(dir, "reloaded")
+	path := writeConf(t, dir, `{"haproxyReloadCmd": "touch `+marker+`", "vips": ["test"], "consulHostPort": "http://127.0.0.1:12424", "consulConfigPath": "/apps/haproxy", "configFile": "`+configFile+`"}`)
+	out := filepath.Join(dir, "preview.cfg")
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+
+	if err := runRender("conf.json", []string{"-c", path, "-o", out}); err != nil {
+		t.Fatalf("TestRunRender returned an error: %v", err)
+	}
+	rendered, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rendered), "backend test-backend") {
+		t.Errorf("TestRunRender output is missing the test VIP:\n%s", rendered)
+	}
+	for _, untouched := range []string{configFile, configFile + ".new", marker} {
+		if _, err := os.Stat(untouched); !os.IsNotExist(err) {
+			t.Errorf("TestRunRender should not have created %s", untouched)
+		}
+	}
+
+	// admin is pinned to lb-1, so it only shows up when rendering for it
+	path = writeConf(t, dir, `{"haproxyReloadCmd": "true", "vips": ["test", "admin"], "nodeName": "lb-2", "consulHostPort": "http://127.0.0.1:12424", "consulConfigPath": "/apps/haproxy", "configFile": "`+configFile+`"}`)
+	for node, expected := range map[string]bool{"": false, "lb-1": true} {
+		if err := runRender(path, []string{"-node", node, "-o", out}); err != nil {
+			t.Fatalf("TestRunRender returned an error: %v", err)
+		}
+		rendered, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(rendered), "frontend admin\n") != expected {
+			t.Errorf("TestRunRender -node %q rendered the pinned VIP: %v, expected %v", node, !expected, expected)
+		}
+	}
+
+	if err := runRender(path, []string{"-o", filepath.Join(dir, "missing", "preview.cfg")}); err == nil {
+		t.Errorf("TestRunRender expected an error writing into a missing directory")
+	}
+}
@@ -0,0 +1,234 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runtimeState is the slot layout of a rendered config. structure is a hash
+// of the config with every slot address blanked, so two configs with the
+// same structure only differ in which instances sit in which slot. config
+// is a hash of the full config text the layout was rendered into.
+type runtimeState struct {
+	structure [32]byte
+	config    [32]byte
+	backends  map[string][]Server
+}
+
+func newRuntimeState() *runtimeState {
+	return &runtimeState{backends: make(map[string][]Server)}
+}
+
+// runtimeEnabled reports whether server membership is managed over the
+// stats socket instead of reloads.
+func (w *Watcher) runtimeEnabled() bool {
+	conf := w.conf()
+	return conf.StatsSocket != "" && conf.ServerSlots > 0
+}
+
+// slotName names the n-th (1 based) slot of a backend.
+func slotName(n int) string {
+	return "srv" + strconv.Itoa(n)
+}
+
+// slotKey identifies the instance sitting in a slot, empty for a free slot.
+func slotKey(s Server) string {
+	if s.Entry.ServiceID == "" {
+		return ""
+	}
+	return s.Entry.Node + "/" + s.Entry.ServiceID
+}
+
+// active reports whether a slot should be taking traffic.
+func (s Server) active() bool {
+	return slotKey(s) != "" && !s.Disabled
+}
+
+// placeholder is s with everything the runtime API can change blanked out.
+func (s Server) placeholder() Server {
+	s.Address = "0.0.0.0"
+	s.Port = 0
+	s.Disabled = false
+	s.Entry = ConsulServiceEntry{}
+	return s
+}
+
+// assignSlots places servers into the fixed slots of backend. Instances keep
+// the slot they had in the running config and new ones fill the lowest free
+// slots; the rest stay as disabled placeholders. A backend only grows, by
+// ServerSlots at a time, when it runs out of slots.
+func (w *Watcher) assignSlots(backend string, servers []Server, backEndConf Backend) []Server {
+	var prev []Server
+	if w.applied != nil {
+		prev = w.applied.backends[backend]
+	}
+	step := w.conf().ServerSlots
+	size := step
+	for size < len(servers) {
+		size += step
+	}
+	if len(prev) > size {
+		size = len(prev)
+	}
+
+	prevSlot := make(map[string]int)
+	for i, s := range prev {
+		if key := slotKey(s); key != "" {
+			prevSlot[key] = i
+		}
+	}
+	slots := make([]Server, size)
+	filled := make([]bool, size)
+	var unplaced []Server
+	for _, s := range servers {
+		if i, ok := prevSlot[slotKey(s)]; ok && !filled[i] {
+			slots[i] = s
+			filled[i] = true
+			continue
+		}
+		unplaced = append(unplaced, s)
+	}
+	next := 0
+	for _, s := range unplaced {
+		for filled[next] {
+			next++
+		}
+		slots[next] = s
+		filled[next] = true
+	}
+
+	// free slots need a port so the runtime API can change it later
+	port := 80
+	if len(servers) > 0 {
+		port = servers[0].Port
+	}
+	for i := range slots {
+		if !filled[i] {
+			slots[i] = Server{Address: "0.0.0.0", Port: port, Disabled: true}
+			slots[i].applyMeta(backEndConf)
+		}
+		slots[i].Name = slotName(i + 1)
+	}
+	if w.pending != nil {
+		w.pending.backends[backend] = slots
+	}
+	return slots
+}
+
+// runtimeCommands works out the stats socket commands that move a running
+// haproxy from the prev slot layout to next. Both layouts must share the
+// same structure.
+func runtimeCommands(prev, next map[string][]Server) []string {
+	backends := make([]string, 0, len(next))
+	for backend := range next {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	var cmds []string
+	for _, backend := range backends {
+		prevSlots := prev[backend]
+		for i, s := range next[backend] {
+			var old Server
+			if i < len(prevSlots) {
+				old = prevSlots[i]
+			}
+			target := backend + "/" + s.Name
+			if !s.active() {
+				if old.active() {
+					cmds = append(cmds, "set server "+target+" state maint")
+				}
+				continue
+			}
+			if old.Address != s.Address || old.Port != s.Port {
+				cmds = append(cmds, "set server "+target+" addr "+s.Address+" port "+strconv.Itoa(s.Port))
+			}
+			if !old.active() {
+				cmds = append(cmds, "set server "+target+" state ready")
+			}
+		}
+	}
+	return cmds
+}
+
+// runtimeErrors are the replies haproxy gives when a command did not apply.
+var runtimeErrors = []string{"No such", "Unknown command", "Permission denied", "Require ", "can't", "Invalid"}
+
+// runtimeCommand sends a single command to the haproxy stats socket and
+// returns the reply.
+func runtimeCommand(socket, cmd string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", err
+	}
+	reply, err := ioutil.ReadAll(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+	out := strings.TrimSpace(string(reply))
+	for _, prefix := range runtimeErrors {
+		if strings.HasPrefix(out, prefix) {
+			return out, errors.New("haproxy rejected \"" + cmd + "\": " + out)
+		}
+	}
+	return out, nil
+}
+
+// runtimeInSync reports whether ConfigFile is still the config w.applied was
+// rendered into. Anything that replaced it behind our back, like a history
+// restore, means haproxy's slots can no longer be trusted to match.
+func (w *Watcher) runtimeInSync() bool {
+	if w.applied == nil {
+		return false
+	}
+	current, err := ioutil.ReadFile(w.conf().ConfigFile)
+	if err != nil {
+		return false
+	}
+	return sha256.Sum256(current) == w.applied.config
+}
+
+// applyRuntime pushes the pending slot layout to haproxy over the stats
+// socket. It only works when the pending config has the same structure as
+// the running one.
+func (w *Watcher) applyRuntime() error {
+	if w.applied == nil || w.pending == nil || w.applied.structure != w.pending.structure {
+		return errors.New("config structure changed")
+	}
+	for _, cmd := range runtimeCommands(w.applied.backends, w.pending.backends) {
+		log.Println("runtime: ", cmd)
+		if _, err := runtimeCommand(w.conf().StatsSocket, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func slotServer(node, address string) Server {
+	return Server{Name: node, Address: address, Port: 8080, Entry: ConsulServiceEntry{Node: node, ServiceID: node}}
+}
+
+func TestAssignSlots(t *testing.T) {
+	mockConf := Conf{StatsSocket: "/tmp/haproxy.sock", ServerSlots: 3}
+	mockWatcher := Watcher{Config: mockConf, pending: newRuntimeState()}
+
+	slots := mockWatcher.assignSlots("test-backend", []Server{slotServer("a", "10.0.0.1"), slotServer("b", "10.0.0.2")}, Backend{})
+	var got []string
+	for _, s := range slots {
+		got = append(got, s.String())
+	}
+	want := []string{
+		"server srv1 10.0.0.1:8080 check",
+		"server srv2 10.0.0.2:8080 check",
+		"server srv3 0.0.0.0:8080 check disabled",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TestAssignSlots first layout is %v, should be %v", got, want)
+	}
+
+	// a leaves, c joins and takes the lowest free slot while b stays put
+	mockWatcher.applied = mockWatcher.pending
+	mockWatcher.pending = newRuntimeState()
+	slots = mockWatcher.assignSlots("test-backend", []Server{slotServer("b", "10.0.0.2"), slotServer("c", "10.0.0.3")}, Backend{})
+	if slots[0].Entry.Node != "c" || slots[1].Entry.Node != "b" || slotKey(slots[2]) != "" {
+		t.Errorf("TestAssignSlots did not keep b in its slot: %v", slots)
+	}
+
+	// running out of slots grows the backend by ServerSlots
+	servers := []Server{slotServer("a", "1"), slotServer("b", "2"), slotServer("c", "3"), slotServer("d", "4")}
+	if slots := mockWatcher.assignSlots("test-backend", servers, Backend{}); len(slots) != 6 {
+		t.Errorf("TestAssignSlots has %d slots for 4 servers, should be 6", len(slots))
+	}
+}
+
+func TestRuntimeCommands(t *testing.T) {
+	empty := Server{Name: "srv3", Address: "0.0.0.0", Port: 8080, Disabled: true}
+	prev := map[string][]Server{"test-backend": {
+		withName(slotServer("a", "10.0.0.1"), "srv1"),
+		withName(slotServer("b", "10.0.0.2"), "srv2"),
+		empty,
+	}}
+	critical := withName(slotServer("b", "10.0.0.2"), "srv2")
+	critical.Disabled = true
+	next := map[string][]Server{"test-backend": {
+		withName(slotServer("c", "10.0.0.3"), "srv1"),
+		critical,
+		withName(slotServer("d", "10.0.0.4"), "srv3"),
+	}}
+	want := []string{
+		"set server test-backend/srv1 addr 10.0.0.3 port 8080",
+		"set server test-backend/srv2 state maint",
+		"set server test-backend/srv3 addr 10.0.0.4 port 8080",
+		"set server test-backend/srv3 state ready",
+	}
+	if got := runtimeCommands(prev, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("TestRuntimeCommands is %v, should be %v", got, want)
+	}
+}
+
+func withName(s Server, name string) Server {
+	s.Name = name
+	return s
+}
+
+// fakeStatsSocket records every command sent to it and answers "No such
+// server." for srv9.
+func fakeStatsSocket(t *testing.T, path string) (*[]string, func()) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var cmds []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			line = strings.TrimSpace(line)
+			mu.Lock()
+			cmds = append(cmds, line)
+			mu.Unlock()
+			if strings.Contains(line, "/srv9 ") {
+				conn.Write([]byte("No such server.\n\n"))
+			} else {
+				conn.Write([]byte("\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return &cmds, func() { l.Close() }
+}
+
+func TestApplyRuntime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "haproxy.sock")
+	cmds, stop := fakeStatsSocket(t, socket)
+	defer stop()
+
+	mockConf := Conf{StatsSocket: socket, ServerSlots: 2}
+	mockWatcher := Watcher{Config: mockConf}
+	mockWatcher.applied = newRuntimeState()
+	mockWatcher.applied.backends["test-backend"] = []Server{withName(slotServer("a", "10.0.0.1"), "srv1")}
+	mockWatcher.pending = newRuntimeState()
+	mockWatcher.pending.backends["test-backend"] = []Server{withName(slotServer("b", "10.0.0.2"), "srv1")}
+
+	if err := mockWatcher.applyRuntime(); err != nil {
+		t.Fatalf("TestApplyRuntime returned an error: %v", err)
+	}
+	want := []string{"set server test-backend/srv1 addr 10.0.0.2 port 8080"}
+	if !reflect.DeepEqual(*cmds, want) {
+		t.Errorf("TestApplyRuntime sent %v, should be %v", *cmds, want)
+	}
+
+	mockWatcher.pending.backends["test-backend"] = []Server{withName(slotServer("b", "10.0.0.2"), "srv9")}
+	if err := mockWatcher.applyRuntime(); err == nil {
+		t.Errorf("TestApplyRuntime expected haproxy's error reply to fail the update")
+	}
+
+	mockWatcher.pending.structure[0] = 1
+	if err := mockWatcher.applyRuntime(); err == nil {
+		t.Errorf("TestApplyRuntime expected a structure change to be refused")
+	}
+}
+
+func TestApplyConfigRuntimeSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "haproxy.sock")
+	cmds, stop := fakeStatsSocket(t, socket)
+	defer stop()
+	configFile := filepath.Join(dir, "haproxy.cfg")
+	marker := filepath.Join(dir, "reloaded")
+
+	mockConf := Conf{ReloadCmd: "touch " + marker, ConfigFile: configFile, StatsSocket: socket, ServerSlots: 2}
+	mockWatcher := Watcher{Config: mockConf}
+	reset := func(running string, next bool) {
+		*cmds = nil
+		os.Remove(marker)
+		if err := ioutil.WriteFile(configFile, []byte(running), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if next {
+			if err := ioutil.WriteFile(mockWatcher.tempPath(), []byte("new\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mockWatcher.applied = newRuntimeState()
+		mockWatcher.applied.config = sha256.Sum256([]byte("old\n"))
+		mockWatcher.applied.backends["test-backend"] = []Server{withName(slotServer("a", "10.0.0.1"), "srv1")}
+		mockWatcher.pending = newRuntimeState()
+		mockWatcher.pending.backends["test-backend"] = []Server{withName(slotServer("b", "10.0.0.2"), "srv1")}
+	}
+	reloaded := func() bool {
+		_, err := os.Stat(marker)
+		return err == nil
+	}
+
+	// the file is the one the slots were applied from
+	reset("old\n", true)
+	if err := mockWatcher.applyConfig(false); err != nil {
+		t.Fatalf("TestApplyConfigRuntimeSync returned an error: %v", err)
+	}
+	if len(*cmds) != 1 || reloaded() {
+		t.Errorf("TestApplyConfigRuntimeSync should have updated over the socket, sent %v, reloaded %v", *cmds, reloaded())
+	}
+
+	// the file was replaced behind our back, e.g. by a history restore
+	reset("restored\n", true)
+	if err := mockWatcher.applyConfig(false); err != nil {
+		t.Fatalf("TestApplyConfigRuntimeSync returned an error: %v", err)
+	}
+	if len(*cmds) != 0 || !reloaded() {
+		t.Errorf("TestApplyConfigRuntimeSync should have reloaded a restored config, sent %v, reloaded %v", *cmds, reloaded())
+	}
+
+	// the socket took the update but the new file can not be installed
+	reset("old\n", false)
+	if err := mockWatcher.applyConfig(false); err == nil {
+		t.Errorf("TestApplyConfigRuntimeSync expected the failed install to be reported")
+	}
+	if len(*cmds) != 1 || !reloaded() {
+		t.Errorf("TestApplyConfigRuntimeSync should have reloaded after the failed install, sent %v, reloaded %v", *cmds, reloaded())
+	}
+}
+
+func TestBuildConfigRuntimeSlots(t *testing.T) {
+	mockConf := Conf{VIPs: []string{"test", "pg"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy", StatsSocket: "/tmp/haproxy.sock", ServerSlots: 3}
+	mockWatcher := Watcher{Config: mockConf, pending: newRuntimeState()}
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+	if err := mockWatcher.buildConfig(); err != nil {
+		t.Fatalf("TestBuildConfigRuntimeSlots returned an error: %v", err)
+	}
+	for _, line := range []string{
+		"server srv1 10.109.192.82:8080 check\n",
+		"server srv2 10.109.192.76:8080 check\n",
+		"server srv3 0.0.0.0:8080 check disabled\n",
+	} {
+		if !strings.Contains(confText.String(), line) {
+			t.Errorf("TestBuildConfigRuntimeSlots is missing %q", line)
+		}
+	}
+	if len(mockWatcher.pending.backends["test-backend"]) != 3 {
+		t.Errorf("TestBuildConfigRuntimeSlots did not record the slot layout")
+	}
+	// the empty slot is not counted as a server
+	var buf bytes.Buffer
+	metrics.backendServers.writeTo(&buf)
+	if !strings.Contains(buf.String(), `conf_builder_backend_servers{backend="test-backend"} 2`+"\n") {
+		t.Errorf("TestBuildConfigRuntimeSlots counted placeholder slots as servers:\n%s", buf.String())
+	}
+	// listen sections are addressed by the VIP name
+	if len(mockWatcher.pending.backends["pg"]) != 3 {
+		t.Errorf("TestBuildConfigRuntimeSlots did not record the slot layout of the listen section")
+	}
+
+	// the same build with different members has the same structure
+	first := mockWatcher.pending.structure
+	mockWatcher.applied = mockWatcher.pending
+	mockWatcher.applied.backends["test-backend"] = []Server{withName(slotServer("other", "10.0.0.9"), "srv1")}
+	mockWatcher.pending = newRuntimeState()
+	confText.Reset()
+	if err := mockWatcher.buildConfig(); err != nil {
+		t.Fatalf("TestBuildConfigRuntimeSlots returned an error: %v", err)
+	}
+	if mockWatcher.pending.structure != first {
+		t.Errorf("TestBuildConfigRuntimeSlots structure changed with only membership changes")
+	}
+}
@@ -0,0 +1,296 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// consul health check states, worst last
+const (
+	healthPassing  = "passing"
+	healthWarning  = "warning"
+	healthCritical = "critical"
+)
+
+// service meta keys that tune the rendered server line
+const (
+	metaWeight     = "haproxy-weight"
+	metaBackup     = "haproxy-backup"
+	metaMaxconn    = "haproxy-maxconn"
+	metaServerOpts = "haproxy-server-opts"
+)
+
+// Server is a single rendered server line in a backend.
+type Server struct {
+	Name     string
+	Address  string
+	Port     int
+	Weight   string
+	Maxconn  string
+	Backup   bool
+	Options  string
+	Disabled bool
+	Entry    ConsulServiceEntry
+}
+
+func (s Server) String() string {
+	line := "server " + s.Name + " " + s.Address + ":" + strconv.Itoa(s.Port) + " check"
+	if s.Weight != "" {
+		line += " weight " + s.Weight
+	}
+	if s.Maxconn != "" {
+		line += " maxconn " + s.Maxconn
+	}
+	if s.Backup {
+		line += " backup"
+	}
+	if s.Options != "" {
+		line += " " + s.Options
+	}
+	if s.Disabled {
+		line += " disabled"
+	}
+	return line
+}
+
+// applyMeta fills in the per-instance server settings from the service
+// metadata, falling back to the backend defaults when a key is missing.
+func (s *Server) applyMeta(backEndConf Backend) {
+	meta := s.Entry.ServiceMeta
+	s.Weight = numericSetting(meta[metaWeight], backEndConf.DefaultWeight, s.Name, metaWeight)
+	s.Maxconn = numericSetting(meta[metaMaxconn], backEndConf.DefaultMaxconn, s.Name, metaMaxconn)
+	s.Backup = meta[metaBackup] == "true"
+	s.Options = strings.TrimSpace(backEndConf.DefaultServerOpts)
+	if opts, ok := meta[metaServerOpts]; ok {
+		s.Options = lineSetting(opts, s.Options, s.Name, metaServerOpts)
+	}
+}
+
+// lineSetting returns value when it fits on a single config line and def
+// otherwise. Service meta is set by whoever registers the service, so a
+// value with newlines or other control characters must never reach the
+// config where it could add whole sections.
+func lineSetting(value, def, name, key string) string {
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		log.Printf("ignoring %s with control characters %q on %s\n", key, value, name)
+		return def
+	}
+	return strings.TrimSpace(value)
+}
+
+// numericSetting returns value when it is a valid number and def otherwise.
+// A bad value is logged rather than rendered so haproxy never sees it.
+func numericSetting(value, def, name, key string) string {
+	value = strings.TrimSpace(value)
+	def = strings.TrimSpace(def)
+	if value == "" {
+		return def
+	}
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		log.Printf("ignoring invalid %s %q on %s\n", key, value, name)
+		return def
+	}
+	return value
+}
+
+// serverName names the server line of entry. Containers that register their
+// own address often run several instances on one node, so the ServiceID is
+// added unless it is just the node or the service name. Anything haproxy does
+// not accept in a server name is replaced with an underscore.
+func serverName(entry ConsulServiceEntry) string {
+	name := entry.Node
+	if entry.ServiceID != "" && entry.ServiceID != entry.Node && entry.ServiceID != entry.ServiceName {
+		name += "-" + entry.ServiceID
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == ':':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// healthStatus folds the checks of a single instance into the worst state.
+func healthStatus(checks []ConsulHealthCheck) string {
+	status := healthPassing
+	for _, check := range checks {
+		switch check.Status {
+		case healthPassing:
+		case healthWarning:
+			if status == healthPassing {
+				status = healthWarning
+			}
+		default:
+			// critical and maintenance both mean no traffic
+			return healthCritical
+		}
+	}
+	return status
+}
+
+// healthAccepted reports whether an instance in status passes filter.
+func healthAccepted(filter, status string) bool {
+	switch filter {
+	case "any":
+		return true
+	case "warning-ok":
+		return status != healthCritical
+	default:
+		return status == healthPassing
+	}
+}
+
+// parseTags splits a comma separated tag list into the tags an instance must
+// have and the !tags it must not have.
+func parseTags(tags string) (include, exclude []string) {
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "" || tag == "!":
+		case strings.HasPrefix(tag, "!"):
+			exclude = append(exclude, tag[1:])
+		default:
+			include = append(include, tag)
+		}
+	}
+	return include, exclude
+}
+
+// tagsMatch reports whether serviceTags has every include tag and none of
+// the exclude tags.
+func tagsMatch(serviceTags, include, exclude []string) bool {
+	for _, tag := range include {
+		if !contains(serviceTags, tag) {
+			return false
+		}
+	}
+	for _, tag := range exclude {
+		if contains(serviceTags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// serverAddress picks the address to render for entry. service prefers the
+// address the instance registered itself with and falls back to the node,
+// lan/wan use the node's tagged addresses.
+func serverAddress(entry ConsulServiceEntry, source string) (string, error) {
+	switch source {
+	case "", "service":
+		if entry.ServiceAddress != "" {
+			return entry.ServiceAddress, nil
+		}
+		return entry.Address, nil
+	case "node":
+		return entry.Address, nil
+	case "lan", "wan":
+		if address := entry.TaggedAddresses[source]; address != "" {
+			return address, nil
+		}
+		return entry.Address, nil
+	default:
+		return "", errors.New("unknown addressSource " + source + ", expected service, node, lan or wan")
+	}
+}
+
+// getBackendServers returns the server lines for a dynamic backend based on
+// the health of every instance of its catalogMapping service that matches its
+// tags. Instances that fail the healthFilter are dropped, or kept as disabled when
+// disableCritical is set.
+func (w *Watcher) getBackendServers(backEndConf Backend) ([]Server, error) {
+	filter := backEndConf.HealthFilter
+	switch filter {
+	case "":
+		filter = "passing"
+	case "passing", "warning-ok", "any":
+	default:
+		return nil, errors.New("unknown healthFilter " + filter + ", expected passing, warning-ok or any")
+	}
+	disableCritical := backEndConf.DisableCritical == "true"
+
+	include, exclude := parseTags(backEndConf.Tags)
+
+	query := url.Values{}
+	// let consul do the filtering when nothing else needs to be rendered
+	if filter == "passing" && !disableCritical {
+		query.Set("passing", "")
+	}
+	// consul can only filter on a single tag, the rest is done below
+	if len(include) > 0 {
+		query.Set("tag", include[0])
+	}
+	path := "/v1/health/service/" + url.PathEscape(backEndConf.CatalogMapping)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	res, err := w.consulGet(path)
+	if err != nil {
+		log.Println("Error getting consul health: ", err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Println("Error reading body: ", err)
+		return nil, err
+	}
+
+	var consulRes []ConsulHealthEntry
+	err = json.Unmarshal(body, &consulRes)
+	if err != nil {
+		log.Println("Error unmarshaling health JSON: ", err)
+		return nil, err
+	}
+
+	var servers []Server
+	for _, health := range consulRes {
+		entry := health.serviceEntry()
+		if !tagsMatch(entry.ServiceTags, include, exclude) {
+			continue
+		}
+		accepted := healthAccepted(filter, entry.Status)
+		if !accepted && !disableCritical {
+			continue
+		}
+		address, err := serverAddress(entry, backEndConf.AddressSource)
+		if err != nil {
+			return nil, err
+		}
+		server := Server{
+			Name:     serverName(entry),
+			Address:  address,
+			Port:     entry.ServicePort,
+			Disabled: !accepted,
+			Entry:    entry,
+		}
+		server.applyMeta(backEndConf)
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
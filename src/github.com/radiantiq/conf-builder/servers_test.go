@@ -0,0 +1,85 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestServerMeta(t *testing.T) {
+	backend := Backend{DefaultWeight: "100", DefaultServerOpts: "inter 2s"}
+	tests := []struct {
+		meta map[string]string
+		want string
+	}{
+		{nil, "server node1 10.0.0.1:8080 check weight 100 inter 2s"},
+		{map[string]string{metaWeight: "10"}, "server node1 10.0.0.1:8080 check weight 10 inter 2s"},
+		{map[string]string{metaWeight: "ten"}, "server node1 10.0.0.1:8080 check weight 100 inter 2s"},
+		{map[string]string{metaMaxconn: "500", metaBackup: "true"}, "server node1 10.0.0.1:8080 check weight 100 maxconn 500 backup inter 2s"},
+		{map[string]string{metaServerOpts: "send-proxy"}, "server node1 10.0.0.1:8080 check weight 100 send-proxy"},
+		{map[string]string{metaServerOpts: ""}, "server node1 10.0.0.1:8080 check weight 100"},
+		{map[string]string{metaServerOpts: "inter 2s\nfrontend evil\n  bind :22"}, "server node1 10.0.0.1:8080 check weight 100 inter 2s"},
+		{map[string]string{metaServerOpts: "send-proxy\r"}, "server node1 10.0.0.1:8080 check weight 100 inter 2s"},
+		{map[string]string{metaServerOpts: "send-proxy\x00"}, "server node1 10.0.0.1:8080 check weight 100 inter 2s"},
+	}
+	for _, test := range tests {
+		server := Server{Name: "node1", Address: "10.0.0.1", Port: 8080, Entry: ConsulServiceEntry{ServiceMeta: test.meta}}
+		server.applyMeta(backend)
+		if server.String() != test.want {
+			t.Errorf("TestServerMeta(%v) is %q, should be %q", test.meta, server.String(), test.want)
+		}
+	}
+
+	server := Server{Name: "node1", Address: "10.0.0.1", Port: 8080, Disabled: true}
+	server.applyMeta(Backend{})
+	if server.String() != "server node1 10.0.0.1:8080 check disabled" {
+		t.Errorf("TestServerMeta without defaults is %q", server.String())
+	}
+}
+
+func TestServerName(t *testing.T) {
+	tests := []struct {
+		entry ConsulServiceEntry
+		want  string
+	}{
+		{ConsulServiceEntry{Node: "node1", ServiceID: "node1", ServiceName: "web"}, "node1"},
+		{ConsulServiceEntry{Node: "node1", ServiceID: "web", ServiceName: "web"}, "node1"},
+		{ConsulServiceEntry{Node: "node1", ServiceName: "web"}, "node1"},
+		{ConsulServiceEntry{Node: "node1", ServiceID: "web-8f3a", ServiceName: "web"}, "node1-web-8f3a"},
+		{ConsulServiceEntry{Node: "node1", ServiceID: "web/1 blue", ServiceName: "web"}, "node1-web_1_blue"},
+	}
+	for _, test := range tests {
+		if name := serverName(test.entry); name != test.want {
+			t.Errorf("TestServerName(%+v) is %q, should be %q", test.entry, name, test.want)
+		}
+	}
+
+	// two containers on the same node get a server line each
+	backend := `[
+  {"Node": {"Node": "docker-1", "Address": "10.0.0.1"}, "Service": {"ID": "web-a1", "Service": "web", "Address": "172.17.0.2", "Port": 8080}},
+  {"Node": {"Node": "docker-1", "Address": "10.0.0.1"}, "Service": {"ID": "web-b2", "Service": "web", "Address": "172.17.0.3", "Port": 8080}}
+]`
+	var entries []ConsulHealthEntry
+	if err := json.Unmarshal([]byte(backend), &entries); err != nil {
+		t.Fatal(err)
+	}
+	a, b := serverName(entries[0].serviceEntry()), serverName(entries[1].serviceEntry())
+	if a == b {
+		t.Errorf("TestServerName gave both instances on docker-1 the name %q", a)
+	}
+}
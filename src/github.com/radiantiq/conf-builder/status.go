@@ -0,0 +1,174 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReloadResult describes the last attempt to apply a config, either through
+// a reload or over the stats socket.
+type ReloadResult struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// ErrorRecord is the last error reported on ErrorChan.
+type ErrorRecord struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Status is what /status reports.
+type Status struct {
+	Index            uint64        `json:"index"`
+	KVIndex          uint64        `json:"kvIndex"`
+	LastBuild        *time.Time    `json:"lastBuild,omitempty"`
+	LastReload       *ReloadResult `json:"lastReload,omitempty"`
+	LastError        *ErrorRecord  `json:"lastError,omitempty"`
+	SkippedReloads   uint64        `json:"skippedReloads"`
+	DryRun           bool          `json:"dryRun"`
+	PendingDiffLines int           `json:"pendingDiffLines"`
+	PendingDiff      string        `json:"pendingDiff,omitempty"`
+	LastDiff         string        `json:"lastDiff,omitempty"`
+}
+
+// statusTracker keeps the Status and the last rendered config for the HTTP
+// API, which reads them while the watcher is running.
+type statusTracker struct {
+	sync.Mutex
+	status Status
+	config string
+}
+
+func (s *statusTracker) recordBuild(config string) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.status.LastBuild = &now
+	s.config = config
+}
+
+func (s *statusTracker) recordReload(method string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	result := &ReloadResult{Time: time.Now(), Method: method}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	s.status.LastReload = result
+}
+
+func (s *statusTracker) recordPendingDiff(diff string, lines int) {
+	s.Lock()
+	defer s.Unlock()
+	s.status.PendingDiff = diff
+	s.status.PendingDiffLines = lines
+}
+
+func (s *statusTracker) recordDiff(diff string) {
+	s.Lock()
+	defer s.Unlock()
+	s.status.LastDiff = diff
+}
+
+func (s *statusTracker) recordError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.status.LastError = &ErrorRecord{Time: time.Now(), Message: err.Error()}
+}
+
+// reportError records err for /status and hands it to ErrorChan.
+func (w *Watcher) reportError(err error) {
+	w.status.recordError(err)
+	w.ErrorChan <- err
+}
+
+// Status returns a snapshot of what the watcher is doing.
+func (w *Watcher) Status() Status {
+	w.status.Lock()
+	status := w.status.status
+	w.status.Unlock()
+	status.Index = atomic.LoadUint64(&w.Index)
+	status.KVIndex = atomic.LoadUint64(&w.KVIndex)
+	status.SkippedReloads = atomic.LoadUint64(&w.skippedReloads)
+	status.DryRun = w.conf().DryRun
+	return status
+}
+
+// statusMux serves the local status and control API.
+func (w *Watcher) statusMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok\n")
+	})
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(w.Status())
+	})
+	mux.HandleFunc("/config", func(rw http.ResponseWriter, r *http.Request) {
+		w.status.Lock()
+		config := w.status.config
+		w.status.Unlock()
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(rw, config)
+	})
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(rw)
+	})
+	mux.HandleFunc("/rebuild", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "use POST to force a rebuild", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Println("rebuild requested over http")
+		if err := w.forceRebuild(); err != nil {
+			w.reportError(err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(rw, "ok\n")
+	})
+	return mux
+}
+
+// serveStatus runs the status API on addr until ctx is cancelled or it
+// fails.
+func (w *Watcher) serveStatus(ctx context.Context, addr string) error {
+	log.Println("serving status on ", addr)
+	server := &http.Server{Addr: addr, Handler: w.statusMux()}
+	go func() {
+		<-ctx.Done()
+		// stop taking requests, a running rebuild is waited for by Watch
+		server.Close()
+	}()
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
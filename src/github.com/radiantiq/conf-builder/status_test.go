@@ -0,0 +1,93 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStatusAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockConf := Conf{ReloadCmd: "true", VIPs: []string{"test"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy", ConfigFile: filepath.Join(dir, "haproxy.cfg")}
+	mockWatcher := &Watcher{Index: 115780, KVIndex: 115762, Config: mockConf, ErrorChan: make(chan error, 10)}
+	mux := mockWatcher.statusMux()
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", "/health", nil))
+	if res.Code != 200 || res.Body.String() != "ok\n" {
+		t.Errorf("TestStatusAPI /health returned %d %q", res.Code, res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", "/rebuild", nil))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("TestStatusAPI GET /rebuild returned %d, should be 405", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("POST", "/rebuild", nil))
+	if res.Code != 200 {
+		t.Fatalf("TestStatusAPI POST /rebuild returned %d: %s", res.Code, res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", "/config", nil))
+	if !strings.Contains(res.Body.String(), "backend test-backend") {
+		t.Errorf("TestStatusAPI /config does not hold the rendered config: %q", res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("GET", "/status", nil))
+	var status Status
+	if err := json.Unmarshal(res.Body.Bytes(), &status); err != nil {
+		t.Fatalf("TestStatusAPI /status is not JSON: %v", err)
+	}
+	if status.Index != 115780 || status.KVIndex != 115762 {
+		t.Errorf("TestStatusAPI /status has the wrong indexes: %+v", status)
+	}
+	if status.LastBuild == nil || status.LastReload == nil || status.LastReload.Method != "reload" || status.LastReload.Error != "" {
+		t.Errorf("TestStatusAPI /status is missing the last build/reload: %+v", status)
+	}
+
+	// a failed forced rebuild shows up as the last error
+	mockWatcher.Config.ReloadCmd = "false"
+	res = httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest("POST", "/rebuild", nil))
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("TestStatusAPI failed POST /rebuild returned %d, should be 500", res.Code)
+	}
+	if status := mockWatcher.Status(); status.LastError == nil || status.LastReload.Error == "" {
+		t.Errorf("TestStatusAPI /status is missing the failure: %+v", status)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// ConfigData is handed to the top level config template.
+type ConfigData struct {
+	Global   string
+	Defaults string
+	VIPs     []VIPData
+}
+
+// VIPData is handed to the VIP template. Frontend, Backend and Listen are
+// nil when the VIP has no such section, Servers is only filled for dynamic
+// backends and listen sections.
+type VIPData struct {
+	Name     string
+	Frontend *Frontend
+	Backend  *Backend
+	Listen   *Listen
+	Servers  []Server
+	// DefaultBackend is the backend the frontend routes to, empty for none
+	DefaultBackend string
+	// Text is the VIP rendered with its own template, ready to be dropped
+	// into the config template
+	Text string
+
+	// the same with the server slots blanked, see runtimeState
+	structServers []Server
+	structText    string
+}
+
+// defaultConfigTemplate lays out the whole haproxy.cfg. A templateFile
+// replaces it and may also redefine the "vip" template below.
+const defaultConfigTemplate = `global
+{{.Global}}
+
+defaults
+{{.Defaults}}
+
+{{range .VIPs}}{{.Text}}{{end}}`
+
+// defaultVipTemplate renders a frontend/backend pair or a listen section.
+const defaultVipTemplate = `{{define "vip"}}{{with .Frontend}}frontend {{$.Name}}
+mode {{line .Mode}}bind 0.0.0.0:{{.ListenPort}} {{line .BindOptions}}{{line .StaticConf}}{{with $.DefaultBackend}}default_backend {{.}}
+{{end}}
+{{end}}{{with .Backend}}backend {{$.Name}}-backend
+mode {{line .Mode}}balance {{line .BalanceType}}{{line .StaticConf}}{{range $.Servers}}{{.}}
+{{end}}
+
+{{end}}{{with .Listen}}listen {{$.Name}}
+mode {{line .Mode}}bind {{line .Bind}}balance {{line .BalanceType}}{{line .StaticConf}}{{range $.Servers}}{{.}}
+{{end}}
+
+{{end}}{{end}}`
+
+var templateFuncs = template.FuncMap{
+	// line makes sure s ends in a newline
+	"line": func(s string) string {
+		if strings.HasSuffix(s, "\n") {
+			return s
+		}
+		return s + "\n"
+	},
+	"join":  strings.Join,
+	"trim":  strings.TrimSpace,
+	"lower": strings.ToLower,
+}
+
+// loadTemplates parses the built-in templates and, when configured, the
+// templateFile on top of them. The file is re-read on every build so edits
+// take effect on the next change.
+func (w *Watcher) loadTemplates() (*template.Template, error) {
+	tmpl, err := template.New("config").Funcs(templateFuncs).Parse(defaultVipTemplate)
+	if err != nil {
+		return nil, err
+	}
+	text := defaultConfigTemplate
+	if templateFile := w.conf().TemplateFile; templateFile != "" {
+		file, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(file)
+	}
+	return tmpl.Parse(text)
+}
+
+// renderVip renders a single VIP, with custom as the template body when the
+// VIP has its own template in consul.
+func renderVip(tmpl *template.Template, custom string, data VIPData) (string, error) {
+	name := "vip"
+	if custom != "" {
+		clone, err := tmpl.Clone()
+		if err != nil {
+			return "", err
+		}
+		name = "vip-" + data.Name
+		if _, err := clone.New(name).Parse(custom); err != nil {
+			return "", err
+		}
+		tmpl = clone
+	}
+	var text bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&text, name, data); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
@@ -0,0 +1,95 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderVipTemplate(t *testing.T) {
+	mockWatcher := Watcher{}
+	tmpl, err := mockWatcher.loadTemplates()
+	if err != nil {
+		t.Fatalf("TestRenderVipTemplate failed to load templates: %v", err)
+	}
+	data := VIPData{
+		Name:    "myApp",
+		Backend: &Backend{Mode: "tcp", BalanceType: "leastconn"},
+		Servers: []Server{{Name: "node1", Address: "10.0.0.1", Port: 5432}},
+	}
+
+	res, err := renderVip(tmpl, "", data)
+	if err != nil {
+		t.Errorf("TestRenderVipTemplate returned an error: %v", err)
+	}
+	success := "backend myApp-backend\nmode tcp\nbalance leastconn\n\nserver node1 10.0.0.1:5432 check\n\n\n"
+	if res != success {
+		t.Errorf("TestRenderVipTemplate default is %q, should be %q", res, success)
+	}
+
+	custom := `listen {{.Name}}
+    bind :5432
+    mode {{.Backend.Mode}}
+{{range .Servers}}    {{.}}
+{{end}}`
+	res, err = renderVip(tmpl, custom, data)
+	if err != nil {
+		t.Errorf("TestRenderVipTemplate returned an error: %v", err)
+	}
+	success = "listen myApp\n    bind :5432\n    mode tcp\n    server node1 10.0.0.1:5432 check\n"
+	if res != success {
+		t.Errorf("TestRenderVipTemplate custom is %q, should be %q", res, success)
+	}
+
+	if _, err := renderVip(tmpl, "{{.Missing", data); err == nil {
+		t.Errorf("TestRenderVipTemplate expected a broken template to be rejected")
+	}
+}
+
+func TestBuildConfigTemplateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	templateFile := filepath.Join(dir, "haproxy.cfg.tmpl")
+	text := `{{define "vip"}}# {{.Name}} has {{len .Servers}} servers
+{{end}}defaults
+{{trim .Defaults}}
+{{range .VIPs}}{{.Text}}{{end}}`
+	if err := ioutil.WriteFile(templateFile, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mockConf := Conf{VIPs: []string{"test", "test2"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy", TemplateFile: templateFile}
+	mockWatcher := Watcher{Index: 0, Config: mockConf}
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+	if err := mockWatcher.buildConfig(); err != nil {
+		t.Fatalf("TestBuildConfigTemplateFile returned an error: %v", err)
+	}
+	success := "defaults\nlog\tglobal\ntimeout connect 5000\ntimeout client  50000\ntimeout server  50000\n# test has 2 servers\n# test2 has 2 servers\n"
+	if confText.String() != success {
+		t.Errorf("TestBuildConfigTemplateFile is %q, should be %q", confText.String(), success)
+	}
+}
@@ -16,6 +16,33 @@
 
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration that reads from JSON as a string like "2s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
 type ConsulEntry struct {
 	CreateIndex int64  `json:"CreateIndex"`
 	ModifyIndex int64  `json:"ModifyIndex"`
@@ -33,22 +60,102 @@ type ConsulServiceEntry struct {
 	ServiceTags    []string
 	ServiceAddress string
 	ServicePort    int
+	ServiceMeta    map[string]string
+	// TaggedAddresses holds the node's lan/wan addresses
+	TaggedAddresses map[string]string
+	// Status is the folded health of the instance when it came from the
+	// health endpoint
+	Status string
+}
+
+// ConsulHealthEntry is a single instance from /v1/health/service/<name>.
+type ConsulHealthEntry struct {
+	Node struct {
+		Node            string
+		Address         string
+		TaggedAddresses map[string]string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Tags    []string
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+	Checks []ConsulHealthCheck
+}
+
+type ConsulHealthCheck struct {
+	CheckID string
+	Status  string
+}
+
+// serviceEntry flattens a health entry into the catalog representation.
+func (h ConsulHealthEntry) serviceEntry() ConsulServiceEntry {
+	return ConsulServiceEntry{
+		Node:            h.Node.Node,
+		Address:         h.Node.Address,
+		ServiceID:       h.Service.ID,
+		ServiceName:     h.Service.Service,
+		ServiceTags:     h.Service.Tags,
+		ServiceAddress:  h.Service.Address,
+		ServicePort:     h.Service.Port,
+		ServiceMeta:     h.Service.Meta,
+		TaggedAddresses: h.Node.TaggedAddresses,
+		Status:          healthStatus(h.Checks),
+	}
 }
 
 type Conf struct {
 	ReloadCmd        string   `json:"haproxyReloadCmd"`
+	ValidateCmd      string   `json:"validateCmd"`
 	VIPs             []string `json:"vips"`
 	ConsulHostPort   string   `json:"consulHostPort"`
 	ConfigFile       string   `json:"configFile"`
-	TempFile         string   `json:"tempFile"`
 	ConsulConfigPath string   `json:"consulConfigPath"`
+	TemplateFile     string   `json:"templateFile"`
+	ListenAddr       string   `json:"listenAddr"`
+	HistoryDir       string   `json:"historyDir"`
+	HistoryLimit     int      `json:"historyLimit"`
+	// reloads are delayed until consul has been quiet for ReloadDebounce,
+	// but no longer than ReloadMaxDelay, and are at least
+	// ReloadMinInterval apart
+	ReloadDebounce    Duration `json:"reloadDebounce"`
+	ReloadMaxDelay    Duration `json:"reloadMaxDelay"`
+	ReloadMinInterval Duration `json:"reloadMinInterval"`
+	// how long shutdown waits for a running build/reload to finish
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// DryRun logs what would change instead of applying it
+	DryRun bool `json:"dryRun"`
+	// lines of context around each change in logged diffs
+	DiffContext int `json:"diffContext"`
+	// with a StatsSocket and ServerSlots dynamic backends are rendered as
+	// fixed server slots that are updated over the haproxy runtime API
+	StatsSocket     string `json:"statsSocket"`
+	ServerSlots     int    `json:"serverSlots"`
+	ConsulToken     string `json:"consulToken"`
+	ConsulTokenFile string `json:"consulTokenFile"`
+	// TLS settings for talking to consul over https
+	ConsulCAFile        string `json:"consulCAFile"`
+	ConsulCertFile      string `json:"consulCertFile"`
+	ConsulKeyFile       string `json:"consulKeyFile"`
+	ConsulServerName    string `json:"consulServerName"`
+	ConsulTLSMinVersion string `json:"consulTLSMinVersion"`
+	// ConsulTimeout bounds every consul request except blocking queries
+	ConsulTimeout Duration `json:"consulTimeout"`
+	// VIPSelection says how VIPs is used: list, all, glob or regex.
+	// NodeName is matched against the vip/<name>/nodes allowlists.
+	VIPSelection string `json:"vipSelection"`
+	NodeName     string `json:"nodeName"`
 }
 
 type Frontend struct {
-	BindOptions string
-	ListenPort  string
-	Mode        string
-	StaticConf  string
+	BindOptions    string
+	ListenPort     string
+	Mode           string
+	StaticConf     string
+	DefaultBackend string
 }
 
 type Backend struct {
@@ -57,4 +164,23 @@ type Backend struct {
 	Mode           string
 	StaticConf     string
 	ConfigType     string
+	// HealthFilter is passing (default), warning-ok or any
+	HealthFilter string
+	// DisableCritical renders filtered instances as disabled servers
+	DisableCritical string
+	// Tags is a comma separated list of required tags, !tag excludes
+	Tags string
+	// AddressSource is service (default), node, lan or wan
+	AddressSource string
+	// server line defaults for instances without haproxy-* service meta
+	DefaultWeight     string
+	DefaultMaxconn    string
+	DefaultServerOpts string
+}
+
+// Listen is a listen section: a bind address and a backend in one, with the
+// same balance and server membership settings as a Backend.
+type Listen struct {
+	Bind string
+	Backend
 }
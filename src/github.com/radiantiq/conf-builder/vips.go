@@ -0,0 +1,125 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// vipSelection modes, see Conf.VIPSelection
+const (
+	vipSelectionList  = "list"
+	vipSelectionAll   = "all"
+	vipSelectionGlob  = "glob"
+	vipSelectionRegex = "regex"
+)
+
+// vipMatcher returns the filter vipSelection applies to VIP names found in
+// consul. With list the vips are names, with glob or regex they are
+// patterns that have to match the whole name.
+func (conf Conf) vipMatcher() (func(string) bool, error) {
+	switch conf.VIPSelection {
+	case "", vipSelectionList:
+		return func(name string) bool { return contains(conf.VIPs, name) }, nil
+	case vipSelectionAll:
+		return func(string) bool { return true }, nil
+	case vipSelectionGlob:
+		for _, pattern := range conf.VIPs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.New("bad vip pattern " + pattern + ": " + err.Error())
+			}
+		}
+		return func(name string) bool {
+			for _, pattern := range conf.VIPs {
+				if ok, _ := path.Match(pattern, name); ok {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case vipSelectionRegex:
+		var patterns []*regexp.Regexp
+		for _, pattern := range conf.VIPs {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, errors.New("bad vip pattern " + pattern + ": " + err.Error())
+			}
+			patterns = append(patterns, re)
+		}
+		return func(name string) bool {
+			for _, re := range patterns {
+				if re.MatchString(name) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, errors.New("unknown vipSelection " + conf.VIPSelection + ", expected list, all, glob or regex")
+}
+
+// vipEnabled checks the per-VIP switches under vip/<name>/: enabled set to
+// false turns the VIP off everywhere, and a comma separated nodes list
+// limits it to the HAProxy hosts named there.
+func vipEnabled(tree KVTree, name, nodeName string) bool {
+	prefix := "vip/" + name + "/"
+	if value := strings.TrimSpace(tree.get(prefix + "enabled")); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("ignoring bad enabled value %q for %s\n", value, name)
+		} else if !enabled {
+			log.Println("skipping disabled VIP ", name)
+			return false
+		}
+	}
+	if nodes := splitList(tree.get(prefix + "nodes")); len(nodes) > 0 && !contains(nodes, nodeName) {
+		log.Printf("skipping %s, it is not enabled on node %s\n", name, nodeName)
+		return false
+	}
+	return true
+}
+
+// splitList splits a comma separated list, dropping blanks.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// selectVIPs returns the VIPs in tree this host should render.
+func (conf Conf) selectVIPs(tree KVTree) ([]string, error) {
+	match, err := conf.vipMatcher()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range vipNames(tree) {
+		if match(name) && vipEnabled(tree, name, conf.NodeName) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,90 @@
+/*
+* Copyright 2015 Radiantiq
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelectVIPs(t *testing.T) {
+	tree := KVTree{
+		"frontend/web-blue/mode":  "http",
+		"backend/web-blue/mode":   "http",
+		"backend/web-green/mode":  "http",
+		"frontend/api/mode":       "http",
+		"backend/admin/mode":      "http",
+		"backend/legacy/mode":     "tcp",
+		"vip/legacy/enabled":      "false",
+		"vip/admin/nodes":         "lb-1, lb-2",
+		"vip/web-green/enabled":   "true",
+		"vip/web-green/template":  "{{.Name}}",
+		"vip/template-only/nodes": "lb-1",
+	}
+	cases := []struct {
+		conf     Conf
+		expected []string
+	}{
+		{Conf{VIPs: []string{"api", "legacy", "missing"}}, []string{"api"}},
+		{Conf{VIPSelection: "list", VIPs: []string{"admin"}, NodeName: "lb-2"}, []string{"admin"}},
+		{Conf{VIPSelection: "all", NodeName: "lb-1"}, []string{"admin", "api", "web-blue", "web-green"}},
+		{Conf{VIPSelection: "all", NodeName: "lb-3"}, []string{"api", "web-blue", "web-green"}},
+		{Conf{VIPSelection: "glob", VIPs: []string{"web-*"}}, []string{"web-blue", "web-green"}},
+		{Conf{VIPSelection: "regex", VIPs: []string{"web-(blue|red)", "ap"}}, []string{"web-blue"}},
+	}
+	for _, c := range cases {
+		names, err := c.conf.selectVIPs(tree)
+		if err != nil {
+			t.Errorf("TestSelectVIPs %+v returned an error: %v", c.conf, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, c.expected) {
+			t.Errorf("TestSelectVIPs %s %v selected %v, expected %v", c.conf.VIPSelection, c.conf.VIPs, names, c.expected)
+		}
+	}
+
+	for _, conf := range []Conf{
+		{VIPSelection: "some"},
+		{VIPSelection: "glob", VIPs: []string{"web-["}},
+		{VIPSelection: "regex", VIPs: []string{"web-("}},
+	} {
+		if _, err := conf.selectVIPs(tree); err == nil {
+			t.Errorf("TestSelectVIPs accepted a bad selection: %+v", conf)
+		}
+	}
+}
+
+func TestBuildConfigAllVIPs(t *testing.T) {
+	mockConf := Conf{ReloadCmd: "stop", VIPSelection: "all", ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy"}
+	mockWatcher := Watcher{Config: mockConf}
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+
+	confText.Reset()
+	if err := mockWatcher.buildConfig(); err != nil {
+		t.Fatalf("TestBuildConfigAllVIPs returned an error: %v", err)
+	}
+	for _, vip := range []string{"edge", "stats", "test", "test2"} {
+		if !strings.Contains(confText.String(), "frontend "+vip+"\n") {
+			t.Errorf("TestBuildConfigAllVIPs did not render %s", vip)
+		}
+	}
+}
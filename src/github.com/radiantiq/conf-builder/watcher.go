@@ -17,149 +17,279 @@
 package main
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os/exec"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
 type Watcher struct {
-	StopChan  chan bool
-	DoneChan  chan bool
 	ErrorChan chan error
 	Waitgroup sync.WaitGroup
 	Index     uint64
+	KVIndex   uint64
 	Config    Conf
+	Client    *http.Client
+
+	buildLock sync.Mutex
+	// configLock guards Config and Client, which SIGHUP can swap
+	configLock sync.RWMutex
+	// reloaded is closed when the config is swapped
+	reloaded chan struct{}
+	tokens   tokenSource
+	// trigger is poked by the watch loops whenever consul changes
+	trigger chan struct{}
+	// skippedReloads counts builds that matched the running config
+	skippedReloads uint64
+	// slot layouts of the running config and the one being built
+	applied *runtimeState
+	pending *runtimeState
+	status  statusTracker
 }
 
-func (w *Watcher) Watch() {
-	defer close(w.DoneChan)
-	w.Waitgroup.Add(1)
-	go w.watchService()
+// Watch follows consul and rebuilds the config until ctx is cancelled.
+// Cancelling aborts the consul long-polls right away but lets a build or
+// reload that is already running finish; Watch returns once it has.
+func (w *Watcher) Watch(ctx context.Context) {
+	w.trigger = make(chan struct{}, 1)
+	w.Waitgroup.Add(3)
+	go w.watchLoop(ctx, w.getServiceIndex)
+	go w.watchLoop(ctx, w.getKVIndex)
+	go w.buildLoop(ctx)
 	w.Waitgroup.Wait()
+	// a rebuild forced through the status API may still hold the lock
+	w.buildLock.Lock()
+	w.buildLock.Unlock()
 }
 
-func (w *Watcher) watchService() {
+// buildLoop rebuilds the config whenever the watch loops report a change,
+// collapsing bursts of changes into a single build and reload.
+func (w *Watcher) buildLoop(ctx context.Context) {
 	defer w.Waitgroup.Done()
-	for {
-		err := w.getServiceIndex()
-		if err != nil {
-			w.ErrorChan <- err
-			time.Sleep(time.Second * 2)
-			continue
-		}
-
+	conf := w.conf()
+	c := coalescer{
+		quiet:       conf.ReloadDebounce.Duration,
+		maxDelay:    conf.ReloadMaxDelay.Duration,
+		minInterval: conf.ReloadMinInterval.Duration,
+		retryDelay:  time.Second * 2,
+		retryable:   retryableBuildError,
 	}
-}
-func getConsulTransport() *http.Client {
-	tlsConfig := tls.Config{MaxVersion: tls.VersionTLS11, InsecureSkipVerify: true}
-	myTransport := &http.Transport{
-		DisableKeepAlives: true,
-		TLSClientConfig:   &tlsConfig,
-	}
-	return &http.Client{Transport: myTransport}
+	c.run(ctx.Done(), w.trigger, w.rebuild, w.reportError)
 }
 
-func (w *Watcher) getServiceIndex() error {
-	//TODO: need to be async?
-	// local chans for async GETs
-	respChan := make(chan uint64)
-	errorChan := make(chan error)
-	transClient := getConsulTransport()
+// retryableBuildError reports whether a failed build is worth retrying. A
+// config haproxy rejected only depends on what is in consul, so building it
+// again before the next change would just fail the same way.
+func retryableBuildError(err error) bool {
+	_, invalid := err.(*ValidationError)
+	return !invalid
+}
 
-	// clear out previous config
-	confText.Reset()
-	go func() {
-		res, err := transClient.Get(w.Config.ConsulHostPort + "/v1/catalog/services?index=" + strconv.Itoa(int(w.Index)))
-		defer res.Body.Close()
-		if err != nil {
-			log.Println("error getting service: ", err)
-			errorChan <- err
-		} else {
-			log.Printf("headers: %v\n", res.Header)
-			consulModIndex, err := strconv.Atoi(res.Header["X-Consul-Index"][0])
-			if err != nil {
-				log.Println("error converting consul index: ", err)
-				errorChan <- err
-			}
-			log.Println("consul index is: ", consulModIndex)
-			respChan <- uint64(consulModIndex)
-		}
-	}()
+// requestBuild asks the build loop for a rebuild without blocking. A
+// request that is already queued covers this one.
+func (w *Watcher) requestBuild() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
 
-	for {
-		select {
-		case <-w.StopChan:
-			return nil
-		case e := <-errorChan:
-			return e
-		case index := <-respChan:
-			buildErr := w.buildConfig()
-			if buildErr != nil {
-				return buildErr
-			}
-			buildErr = w.writeConfig()
-			if buildErr != nil {
-				return buildErr
-			}
-			buildErr = w.updateConfig()
-			if buildErr != nil {
-				return buildErr
-			}
-			buildErr = w.copyAndRestart()
-			if buildErr != nil {
-				return buildErr
+// watchLoop runs the blocking query in watch until ctx is cancelled, backing
+// off for a couple of seconds after each error.
+func (w *Watcher) watchLoop(ctx context.Context, watch func(context.Context) error) {
+	defer w.Waitgroup.Done()
+	for ctx.Err() == nil {
+		qctx, cancel := w.queryContext(ctx)
+		err := watch(qctx)
+		abandoned := qctx.Err() != nil
+		cancel()
+		if err != nil && !abandoned {
+			w.reportError(err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second * 2):
 			}
-			w.Index = index
-			return nil
 		}
 	}
+}
+
+// getServiceIndex blocks until the service catalog changes and then asks for
+// a rebuild.
+func (w *Watcher) getServiceIndex(ctx context.Context) error {
+	return w.watchIndex(ctx, "catalog", "/v1/catalog/services", &w.Index)
+}
 
+// getKVIndex blocks until anything under ConsulConfigPath changes and then
+// asks for a rebuild.
+func (w *Watcher) getKVIndex(ctx context.Context) error {
+	return w.watchIndex(ctx, "kv", w.kvTreePath(), &w.KVIndex)
+}
+
+// kvTreePath is the recursive KV query for everything under
+// ConsulConfigPath. consul matches recurse on a plain key prefix, so the
+// trailing slash keeps sibling trees like apps/haproxy-staging out.
+func (w *Watcher) kvTreePath() string {
+	return "/v1/kv/" + strings.Trim(w.conf().ConsulConfigPath, "/") + "/?recurse"
+}
+
+// watchIndex runs a single consul blocking query against path for the named
+// watch. When the returned index differs from lastIndex it is recorded and
+// a rebuild is requested from the build loop. Cancelling ctx aborts the
+// query.
+func (w *Watcher) watchIndex(ctx context.Context, name, path string, lastIndex *uint64) error {
+	index := atomic.LoadUint64(lastIndex)
+	newIndex, err := w.fetchIndex(ctx, path, index)
+	if err != nil {
+		return err
+	}
+	// blocking query timed out without a change
+	if newIndex == index {
+		return nil
+	}
+	atomic.StoreUint64(lastIndex, newIndex)
+	metrics.watchedIndex.set(name, float64(newIndex))
+	w.requestBuild()
 	return nil
 }
 
-func (w *Watcher) getGlobalConfig() (globalConfig []byte, err error) {
-	transClient := getConsulTransport()
-	res, err := transClient.Get(w.Config.ConsulHostPort + "/v1/kv" + w.Config.ConsulConfigPath + "/global")
+// fetchIndex issues a blocking query and returns the X-Consul-Index of the
+// response.
+func (w *Watcher) fetchIndex(ctx context.Context, path string, index uint64) (uint64, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	res, err := w.consulGetContext(ctx, path+separator+"index="+strconv.FormatUint(index, 10))
 	if err != nil {
-		log.Println("error GETing consul value: ", err)
-		return nil, err
+		log.Println("error getting consul index: ", err)
+		return 0, err
 	}
 	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	ioutil.ReadAll(res.Body)
+	consulModIndex, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
 	if err != nil {
-		log.Println("error reading consul response body: ", err)
-		return nil, err
+		log.Println("error converting consul index: ", err)
+		return 0, err
 	}
+	log.Printf("consul index for %s is: %d\n", path, consulModIndex)
+	return consulModIndex, nil
+}
 
-	var consulRes []ConsulEntry
-	err = json.Unmarshal(body, &consulRes)
-	if err != nil {
-		log.Println("error unmarshaling consul response: ", err)
-		return nil, err
+// rebuild runs the full build -> write -> reload cycle. Both watch loops
+// share it so it is serialized on buildLock.
+func (w *Watcher) rebuild() error {
+	return w.runBuild(false)
+}
+
+// forceRebuild runs a build outside the watch loops and applies the result
+// even when it matches the running config.
+func (w *Watcher) forceRebuild() error {
+	return w.runBuild(true)
+}
+
+func (w *Watcher) runBuild(force bool) error {
+	w.buildLock.Lock()
+	defer w.buildLock.Unlock()
+
+	// clear out previous config
+	confText.Reset()
+	w.pending = newRuntimeState()
+	if err := w.buildConfig(); err != nil {
+		return err
+	}
+	w.pending.config = sha256.Sum256(confText.Bytes())
+	w.status.recordBuild(confText.String())
+	if w.conf().DryRun {
+		return w.dryRunConfig()
+	}
+	if !force && !w.updateConfig() {
+		// haproxy is already running exactly this layout
+		w.applied = w.pending
+		return nil
 	}
-	globalConfig, err = base64.StdEncoding.DecodeString(consulRes[0].Value)
+	conf := w.conf()
+	diff, err := diffConfig(conf.ConfigFile, confText.Bytes(), conf.DiffContext)
 	if err != nil {
-		log.Println("error decoding consul value: ", err)
-		return nil, err
+		log.Println("unable to diff against the running config: ", err)
+	}
+	if err := w.writeConfig(); err != nil {
+		return err
+	}
+	if err := w.validateConfig(); err != nil {
+		return err
 	}
-	return globalConfig, nil
+	if err := w.applyConfig(force); err != nil {
+		return err
+	}
+	w.applied = w.pending
+	if diff != "" {
+		log.Printf("applied config changes:\n%s", diff)
+	}
+	w.status.recordDiff(diff)
+	if err := w.archiveConfig(confText.Bytes(), diff, atomic.LoadUint64(&w.Index), atomic.LoadUint64(&w.KVIndex)); err != nil {
+		log.Println("unable to archive applied config: ", err)
+	}
+	return nil
 }
 
-func (w *Watcher) getDefaultsConfig() (defaultsConfig []byte, err error) {
-	transClient := getConsulTransport()
-	res, err := transClient.Get(w.Config.ConsulHostPort + "/v1/kv" + w.Config.ConsulConfigPath + "/defaults")
+// applyConfig puts the validated temp file in place. When only server
+// membership changed it is pushed over the stats socket and the file is
+// installed without a reload, anything else (or a forced build) goes
+// through a full reload.
+func (w *Watcher) applyConfig(force bool) error {
+	runtimeSent := false
+	if !force && w.runtimeEnabled() && w.applied != nil && w.applied.structure == w.pending.structure {
+		switch {
+		case !w.runtimeInSync():
+			log.Println("haproxy config changed since the last apply, falling back to a reload")
+		default:
+			err := w.applyRuntime()
+			if err != nil {
+				log.Println("runtime update failed, falling back to a reload: ", err)
+				break
+			}
+			runtimeSent = true
+			if err = w.installConfig(); err != nil {
+				log.Println("unable to install config after runtime update, falling back to a reload: ", err)
+				break
+			}
+			log.Println("applied server changes over the stats socket, skipping reload")
+			w.status.recordReload("runtime", nil)
+			return nil
+		}
+	}
+	err := w.copyAndRestart()
+	if err != nil && runtimeSent {
+		// haproxy already took the socket commands but the file on disk is
+		// still the old one, reload from it so the two agree again
+		if reloadErr := w.reload(); reloadErr != nil {
+			err = fmt.Errorf("%v, reload of the current config also failed: %v", err, reloadErr)
+		}
+	}
+	w.status.recordReload("reload", err)
+	return err
+}
+
+// getKVTree pulls everything under ConsulConfigPath in a single recursive
+// request so the whole config is built from one consistent consul index.
+func (w *Watcher) getKVTree() (KVTree, error) {
+	res, err := w.consulGet(w.kvTreePath())
 	if err != nil {
-		log.Println("error GETing consul value: ", err)
+		log.Println("error GETing consul kv tree: ", err)
 		return nil, err
 	}
 	defer res.Body.Close()
@@ -175,215 +305,347 @@ func (w *Watcher) getDefaultsConfig() (defaultsConfig []byte, err error) {
 		log.Println("error unmarshaling consul response: ", err)
 		return nil, err
 	}
-	defaultsConfig, err = base64.StdEncoding.DecodeString(consulRes[0].Value)
-	if err != nil {
-		log.Println("error decoding consul value: ", err)
-		return nil, err
+
+	root := strings.Trim(w.conf().ConsulConfigPath, "/") + "/"
+	tree := make(KVTree, len(consulRes))
+	for _, entry := range consulRes {
+		// folders carry no value, and nothing outside root belongs here
+		if strings.HasSuffix(entry.Key, "/") || !strings.HasPrefix(entry.Key, root) {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(entry.Value)
+		if err != nil {
+			log.Println("error decoding consul value for ", entry.Key, ": ", err)
+			return nil, err
+		}
+		tree[strings.TrimPrefix(entry.Key, root)] = string(value)
 	}
-	return defaultsConfig, nil
+	return tree, nil
 }
 
 func (w *Watcher) buildConfig() error {
-	transClient := getConsulTransport()
-	// get global
-	globalConf, err := w.getGlobalConfig()
+	defer metrics.buildDuration.since("", time.Now())
+	tmpl, err := w.loadTemplates()
 	if err != nil {
+		log.Println("Error loading config template: ", err)
 		return err
 	}
-	confText.WriteString("global\n")
-	confText.WriteString(string(globalConf))
-	confText.WriteString("\n\n")
-	// get defaults
-	defaultsConf, err := w.getDefaultsConfig()
+	tree, err := w.getKVTree()
 	if err != nil {
 		return err
 	}
-	confText.WriteString("defaults\n")
-	confText.WriteString(string(defaultsConf))
-	confText.WriteString("\n\n")
-	// get all VIPs
-	res, err := transClient.Get(w.Config.ConsulHostPort + "/v1/kv" + w.Config.ConsulConfigPath + "/backend/?keys&separator=/")
-	if err != nil {
-		log.Println("Error getting VIP list from consul: ", err)
-		// no VIPs returned but we have global/defaults we can write
-		return nil
+	// get global
+	if !tree.has("global") {
+		return errors.New("no global config found under " + w.conf().ConsulConfigPath)
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		log.Println("Error reading body: ", err)
-		// no VIPs returned but we have global/defaults we can write
-		return nil
+	// get defaults
+	if !tree.has("defaults") {
+		return errors.New("no defaults config found under " + w.conf().ConsulConfigPath)
 	}
-	var consulRes []string
-	err = json.Unmarshal(body, &consulRes)
+	data := ConfigData{Global: tree.get("global"), Defaults: tree.get("defaults")}
+	vips, err := w.conf().selectVIPs(tree)
 	if err != nil {
-		log.Println("Error unmarshaling frontend list JSON: ", err)
-		// no VIPs returned but we have global/defaults we can write
-		return nil
+		return err
 	}
 	// build VIP config
-	for _, val := range consulRes {
-		if contains(w.Config.VIPs, filepath.Base(val)) {
-			log.Println("building ", filepath.Base(val))
-			isSuccess := w.buildVipConf(filepath.Base(val))
-			if !isSuccess {
-				log.Println("Error building VIP config for ", filepath.Base(val))
+	for _, val := range vips {
+		log.Println("building ", val)
+		vip, err := w.buildVipConf(tree, tmpl, val, vips)
+		if err != nil {
+			log.Println("Error building VIP config for ", val, ": ", err)
+			// without access to the catalog every VIP would come out
+			// empty, so fail the whole build instead
+			if _, ok := err.(*ConsulForbiddenError); ok {
+				return err
 			}
+			continue
 		}
+		data.VIPs = append(data.VIPs, vip)
 	}
 
+	if err := tmpl.Execute(&confText, data); err != nil {
+		return err
+	}
+	metrics.vipsRendered.set("", float64(len(data.VIPs)))
+	metrics.backendServers.reset()
+	for _, vip := range data.VIPs {
+		if vip.Backend != nil {
+			metrics.backendServers.set(vip.Name+"-backend", activeServers(vip.Servers))
+		}
+		if vip.Listen != nil {
+			metrics.backendServers.set(vip.Name, activeServers(vip.Servers))
+		}
+	}
+	if w.runtimeEnabled() && w.pending != nil {
+		// render again with the slots blanked out to fingerprint the
+		// structure of the config
+		structure := data
+		structure.VIPs = make([]VIPData, len(data.VIPs))
+		for i, vip := range data.VIPs {
+			vip.Servers = vip.structServers
+			vip.Text = vip.structText
+			structure.VIPs[i] = vip
+		}
+		var text bytes.Buffer
+		if err := tmpl.Execute(&text, structure); err != nil {
+			return err
+		}
+		w.pending.structure = sha256.Sum256(text.Bytes())
+	}
 	return nil
 }
+
 func (w *Watcher) writeConfig() error {
 	// write config
 	log.Println(confText.String())
-	if err := ioutil.WriteFile(w.Config.TempFile, confText.Bytes(), 0644); err != nil {
+	if err := writeFileSync(w.tempPath(), confText.Bytes(), 0644); err != nil {
 		log.Println("Unable to write temp config file: ", err)
 		return err
 	}
 	return nil
 }
 
-func (w *Watcher) updateConfig() error {
-	err := exec.Command("diff", w.Config.ConfigFile, w.Config.TempFile).Run()
-	if err != nil {
-		if msg, ok := err.(*exec.ExitError); ok {
-			log.Printf("exit code: %v\n", msg.Sys().(syscall.WaitStatus).ExitStatus())
-			if msg.Sys().(syscall.WaitStatus).ExitStatus() == 1 {
-				return nil
-			}
-		}
+// ValidationError is returned when haproxy rejects the generated config. The
+// running config is left alone and haproxy is not reloaded.
+type ValidationError struct {
+	Cmd    string
+	Output string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return "generated config failed validation (" + e.Cmd + "): " + e.Err.Error() + "\n" + e.Output
+}
 
+// validateConfig runs validateCmd against the temp file, substituting {file}
+// with its path. An empty validateCmd or "none" skips validation.
+func (w *Watcher) validateConfig() error {
+	validateCmd := w.conf().ValidateCmd
+	if validateCmd == "" || validateCmd == "none" {
+		return nil
+	}
+	cmdline := strings.Replace(validateCmd, "{file}", w.tempPath(), -1)
+	output, err := commandFromString(cmdline).CombinedOutput()
+	if err != nil {
+		log.Println("generated config failed validation: ", err)
+		log.Println("output: ", string(output))
+		return &ValidationError{Cmd: cmdline, Output: string(output), Err: err}
 	}
 	return nil
 }
 
-func (w *Watcher) getFrontendConf(name string) Frontend {
-	// bindOptions
-	bindOptions := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/frontend/" + name + "/bindOptions?raw")
-	// listenPort
-	listenPort := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/frontend/" + name + "/listenPort?raw")
-	// mode
-	mode := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/frontend/" + name + "/mode?raw")
-	// staticConf
-	staticConf := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/frontend/" + name + "/staticConf?raw")
+// updateConfig reports whether the rendered config differs from the one
+// haproxy is running. Unchanged builds are counted and skipped so unrelated
+// catalog changes do not reload haproxy.
+func (w *Watcher) updateConfig() bool {
+	current, err := ioutil.ReadFile(w.conf().ConfigFile)
+	if err != nil {
+		log.Println("unable to read current config, treating it as changed: ", err)
+		return true
+	}
+	if sha256.Sum256(current) != sha256.Sum256(confText.Bytes()) {
+		return true
+	}
+	skipped := atomic.AddUint64(&w.skippedReloads, 1)
+	metrics.buildsSkipped.inc("")
+	log.Printf("config unchanged, skipping reload (%d skipped so far)\n", skipped)
+	return false
+}
 
-	return Frontend{BindOptions: bindOptions, ListenPort: listenPort, Mode: mode, StaticConf: staticConf}
+func (w *Watcher) getFrontendConf(tree KVTree, name string) Frontend {
+	prefix := "frontend/" + name + "/"
+	return Frontend{
+		BindOptions:    tree.get(prefix + "bindOptions"),
+		ListenPort:     tree.get(prefix + "listenPort"),
+		Mode:           tree.get(prefix + "mode"),
+		StaticConf:     tree.get(prefix + "staticConf"),
+		DefaultBackend: tree.get(prefix + "defaultBackend"),
+	}
 }
 
-func (w *Watcher) getBackendConf(name string) Backend {
-	// balance
-	balanceType := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/backend/" + name + "/balance?raw")
-	// catalogMapping
-	catalogMapping := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/backend/" + name + "/catalogMapping?raw")
-	// mode
-	mode := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/backend/" + name + "/mode?raw")
-	// staticConf
-	staticConf := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/backend/" + name + "/staticConf?raw")
-	// type
-	configType := w.getConsulString("/v1/kv" + w.Config.ConsulConfigPath + "/backend/" + name + "/type?raw")
+func (w *Watcher) getBackendConf(tree KVTree, name string) Backend {
+	return backendSettings(tree, "backend/"+name+"/")
+}
 
-	return Backend{BalanceType: balanceType, CatalogMapping: catalogMapping, Mode: mode, StaticConf: staticConf, ConfigType: configType}
+// getListenConf reads listen/<name>/, which takes the backend keys plus
+// bind.
+func (w *Watcher) getListenConf(tree KVTree, name string) Listen {
+	prefix := "listen/" + name + "/"
+	return Listen{
+		Bind:    tree.get(prefix + "bind"),
+		Backend: backendSettings(tree, prefix),
+	}
 }
 
-func (w *Watcher) getConsulString(path string) string {
-	transClient := getConsulTransport()
-	result := ""
-	res, err := transClient.Get(w.Config.ConsulHostPort + path)
-	if err != nil {
-		log.Println("Error getting consul list: ", err)
-		return result
+// backendSettings reads the balance and server membership keys under
+// prefix.
+func backendSettings(tree KVTree, prefix string) Backend {
+	return Backend{
+		BalanceType:       tree.get(prefix + "balance"),
+		CatalogMapping:    tree.get(prefix + "catalogMapping"),
+		Mode:              tree.get(prefix + "mode"),
+		StaticConf:        tree.get(prefix + "staticConf"),
+		ConfigType:        tree.get(prefix + "type"),
+		HealthFilter:      tree.get(prefix + "healthFilter"),
+		DisableCritical:   tree.get(prefix + "disableCritical"),
+		Tags:              tree.get(prefix + "tags"),
+		AddressSource:     tree.get(prefix + "addressSource"),
+		DefaultWeight:     tree.get(prefix + "defaultWeight"),
+		DefaultMaxconn:    tree.get(prefix + "defaultMaxconn"),
+		DefaultServerOpts: tree.get(prefix + "defaultServerOpts"),
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+}
+
+// vipNames lists every VIP that has a frontend, backend or listen section in
+// tree.
+func vipNames(tree KVTree) []string {
+	var names []string
+	for _, section := range []string{"frontend", "backend", "listen"} {
+		for _, name := range tree.children(section) {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultBackendName works out the default_backend of vipName's frontend.
+// The defaultBackend key names another VIP whose backend to route to, or
+// "none" to leave it out; without it the VIP's own backend is used if it
+// has one. An empty result means no default_backend line. The other VIP has
+// to be one of the selected VIPs this host renders and have a backend,
+// otherwise haproxy would refuse the whole config.
+func defaultBackendName(tree KVTree, vipName string, frontend Frontend, hasBackend bool, selected []string) (string, error) {
+	target := frontend.DefaultBackend
+	switch target {
+	case "none":
+		return "", nil
+	case "":
+		if hasBackend {
+			return vipName + "-backend", nil
+		}
+		return "", nil
+	}
+	if !tree.has("backend/" + target) {
+		return "", errors.New("frontend " + vipName + " routes to " + target + ", which has no backend")
+	}
+	if !contains(selected, target) {
+		return "", errors.New("frontend " + vipName + " routes to " + target + ", which is not rendered on this host")
+	}
+	return target + "-backend", nil
+}
+
+// vipServers returns the servers of the haproxy backend or listen section
+// named name. Only dynamic ones have servers, which are put into slots when
+// runtime updates are enabled.
+func (w *Watcher) vipServers(name string, backEndConf Backend) ([]Server, error) {
+	if backEndConf.ConfigType != "dynamic" {
+		return nil, nil
+	}
+	servers, err := w.getBackendServers(backEndConf)
 	if err != nil {
-		log.Println("Error reading body: ", err)
-		return result
+		return nil, err
+	}
+	if w.runtimeEnabled() {
+		servers = w.assignSlots(name, servers, backEndConf)
 	}
-	result = string(body)
-	return result
+	return servers, nil
 }
 
-func (w *Watcher) buildVipConf(vipName string) bool {
-	transClient := getConsulTransport()
-	frontEndConf := w.getFrontendConf(vipName)
-	emptyFrontEnd := Frontend{BindOptions: "", ListenPort: "", Mode: "", StaticConf: ""}
-	if frontEndConf != emptyFrontEnd {
+// buildVipConf gathers everything known about vipName and renders it with
+// the VIP's own template from consul or the default one. selected holds every
+// VIP this build renders.
+func (w *Watcher) buildVipConf(tree KVTree, tmpl *template.Template, vipName string, selected []string) (VIPData, error) {
+	vip := VIPData{Name: vipName}
+	frontEndConf := w.getFrontendConf(tree, vipName)
+	if frontEndConf != (Frontend{}) {
 		log.Println("getting frontend config for ", vipName)
-		confText.WriteString(`frontend ` + vipName)
-		if !strings.HasSuffix(vipName, "\n") {
-			confText.WriteString("\n")
-		}
-		confText.WriteString(`mode ` + frontEndConf.Mode)
-		if !strings.HasSuffix(frontEndConf.Mode, "\n") {
-			confText.WriteString("\n")
-		}
-		confText.WriteString(`bind 0.0.0.0:` + frontEndConf.ListenPort + ` ` + frontEndConf.BindOptions)
-		if !strings.HasSuffix(frontEndConf.BindOptions, "\n") {
-			confText.WriteString("\n")
-		}
-		confText.WriteString(frontEndConf.StaticConf)
-		if !strings.HasSuffix(frontEndConf.StaticConf, "\n") {
-			confText.WriteString("\n")
+		vip.Frontend = &frontEndConf
+	}
+	backEndConf := w.getBackendConf(tree, vipName)
+	if vip.Frontend != nil {
+		name, err := defaultBackendName(tree, vipName, frontEndConf, backEndConf != (Backend{}), selected)
+		if err != nil {
+			return vip, err
 		}
-		confText.WriteString(`default_backend ` + vipName + `-backend`)
-		confText.WriteString("\n\n")
+		vip.DefaultBackend = name
 	}
-	backEndConf := w.getBackendConf(vipName)
-	emptyBackEnd := Backend{BalanceType: "", CatalogMapping: "", Mode: "", StaticConf: "", ConfigType: ""}
-	if backEndConf != emptyBackEnd {
+	if backEndConf != (Backend{}) {
 		log.Println("getting backend config for ", vipName)
-		confText.WriteString(`backend ` + vipName + `-backend`)
-		confText.WriteString("\n")
-		confText.WriteString(`mode ` + backEndConf.Mode)
-		if !strings.HasSuffix(backEndConf.Mode, "\n") {
-			confText.WriteString("\n")
+		vip.Backend = &backEndConf
+		servers, err := w.vipServers(vipName+"-backend", backEndConf)
+		if err != nil {
+			return vip, err
 		}
-		confText.WriteString(`balance ` + backEndConf.BalanceType)
-		if !strings.HasSuffix(backEndConf.BalanceType, "\n") {
-			confText.WriteString("\n")
+		vip.Servers = servers
+	}
+	listenConf := w.getListenConf(tree, vipName)
+	if listenConf != (Listen{}) {
+		// a listen section takes the VIP's name, as does the frontend
+		if vip.Frontend != nil || vip.Backend != nil {
+			return vip, errors.New("VIP " + vipName + " has both a listen section and a frontend/backend")
 		}
-		confText.WriteString(backEndConf.StaticConf)
-		if !strings.HasSuffix(backEndConf.StaticConf, "\n") {
-			confText.WriteString("\n")
+		log.Println("getting listen config for ", vipName)
+		vip.Listen = &listenConf
+		servers, err := w.vipServers(vipName, listenConf.Backend)
+		if err != nil {
+			return vip, err
 		}
-		if backEndConf.ConfigType == "dynamic" {
-			res, err := transClient.Get(w.Config.ConsulHostPort + "/v1/catalog/service/" + backEndConf.CatalogMapping)
-			if err != nil {
-				log.Println("Error getting consul list: ", err)
-				return false
-			}
-			defer res.Body.Close()
-			body, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				log.Println("Error reading body: ", err)
-				return false
-			}
+		vip.Servers = servers
+	}
 
-			var consulRes []ConsulServiceEntry
-			err = json.Unmarshal(body, &consulRes)
-			if err != nil {
-				log.Println("Error unmarshaling service JSON: ", err)
-				return false
-			}
-			for _, entry := range consulRes {
-				confText.WriteString("server " + entry.Node + " " + entry.Address + ":" + strconv.Itoa(entry.ServicePort) + " check\n")
-			}
+	custom := tree.get("vip/" + vipName + "/template")
+	text, err := renderVip(tmpl, custom, vip)
+	if err != nil {
+		return vip, err
+	}
+	vip.Text = text
+	if w.runtimeEnabled() {
+		structure := vip
+		structure.Servers = make([]Server, len(vip.Servers))
+		for i, server := range vip.Servers {
+			structure.Servers[i] = server.placeholder()
+		}
+		if structure.Text, err = renderVip(tmpl, custom, structure); err != nil {
+			return vip, err
 		}
-		confText.WriteString("\n\n")
+		vip.structServers = structure.Servers
+		vip.structText = structure.Text
 	}
-	return true
+	return vip, nil
 }
 
+// copyAndRestart installs the staged config and reloads haproxy. If the
+// reload fails the previous config is restored and haproxy reloaded again.
 func (w *Watcher) copyAndRestart() error {
-	cmd := exec.Command("mv", w.Config.TempFile, w.Config.ConfigFile)
-	if err := cmd.Run(); err != nil {
-		log.Println("unable to copy new haproxy config ", err)
+	metrics.reloads.inc("")
+	defer metrics.reloadDuration.since("", time.Now())
+	if err := w.installConfig(); err != nil {
+		metrics.reloadFailures.inc("")
 		return err
 	}
 
-	cmd = w.getRestartCmd()
+	reloadErr := w.reload()
+	if reloadErr == nil {
+		return nil
+	}
+	metrics.reloadFailures.inc("")
+	log.Println("rolling back to previous haproxy config")
+	if err := w.rollbackConfig(); err != nil {
+		log.Println("unable to roll back haproxy config ", err)
+		return fmt.Errorf("reload failed: %v, rollback failed: %v", reloadErr, err)
+	}
+	if err := w.reload(); err != nil {
+		return fmt.Errorf("reload failed: %v, reload of previous config also failed: %v", reloadErr, err)
+	}
+	return fmt.Errorf("reload failed, previous config restored: %v", reloadErr)
+}
+
+// reload runs the reload command.
+func (w *Watcher) reload() error {
+	cmd := w.getRestartCmd()
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		log.Println("unable to reload haproxy ", err)
@@ -395,16 +657,21 @@ func (w *Watcher) copyAndRestart() error {
 }
 
 func (w *Watcher) getRestartCmd() *exec.Cmd {
-	cmdSplits := strings.Split(w.Config.ReloadCmd, " ")
+	return commandFromString(w.conf().ReloadCmd)
+}
+
+// commandFromString splits cmdline on whitespace into a command and its
+// arguments.
+func commandFromString(cmdline string) *exec.Cmd {
+	cmdSplits := strings.Fields(cmdline)
+	if len(cmdSplits) == 0 {
+		return &exec.Cmd{}
+	}
 	path, err := exec.LookPath(cmdSplits[0])
 	if err != nil {
 		log.Printf("unable to find %s on the system\n", cmdSplits[0])
 	}
-	if len(cmdSplits) == 1 {
-		return &exec.Cmd{Path: path}
-	}
-	returnCmd := exec.Cmd{Path: path, Args: cmdSplits[0:]}
-	return &returnCmd
+	return &exec.Cmd{Path: path, Args: cmdSplits}
 }
 
 func contains(s []string, e string) bool {
@@ -17,12 +17,18 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -63,18 +69,44 @@ func TestGetGlobals(t *testing.T) {
 	s := buildMockServer(false)
 	s.Start()
 
-	res, err := mockWatcher.getGlobalConfig()
+	tree, err := mockWatcher.getKVTree()
 	if err != nil {
-		t.Errorf("TestGetGlobals failure: ", err)
+		t.Errorf("TestGetGlobals failure: %v", err)
 	}
 
-	if string(res) != string(success) {
-		t.Errorf("response is: \n %s \n should be: \n %s \n", string(res), string(success))
+	res := tree.get("global")
+	if res != string(success) {
+		t.Errorf("response is: \n %s \n should be: \n %s \n", res, string(success))
 	}
 	s.Close()
 	//time.Sleep(2 * time.Second)
 }
 
+func TestGetKVTreeSiblings(t *testing.T) {
+	// a consul answering with keys outside the configured tree
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/apps/haproxy/" {
+			t.Errorf("TestGetKVTreeSiblings requested %s, should be the tree below apps/haproxy/", r.URL.Path)
+		}
+		w.Header().Add("X-Consul-Index", "42")
+		writeHeaders(w, 200)
+		w.Write([]byte(`[
+  {"Key": "apps/haproxy/global", "Value": "Z2xvYmFs"},
+  {"Key": "apps/haproxy-staging/global", "Value": "c3RhZ2luZw=="}
+]`))
+	}))
+	defer s.Close()
+
+	mockWatcher := Watcher{Config: Conf{ConsulHostPort: s.URL, ConsulConfigPath: "/apps/haproxy"}}
+	tree, err := mockWatcher.getKVTree()
+	if err != nil {
+		t.Fatalf("TestGetKVTreeSiblings returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(tree, KVTree{"global": "global"}) {
+		t.Errorf("TestGetKVTreeSiblings tree is %v, should only hold global", tree)
+	}
+}
+
 func TestGetDefaults(t *testing.T) {
 	success, _ := base64.StdEncoding.DecodeString("bG9nCWdsb2JhbAp0aW1lb3V0IGNvbm5lY3QgNTAwMAp0aW1lb3V0IGNsaWVudCAgNTAwMDAKdGltZW91dCBzZXJ2ZXIgIDUwMDAw")
 	mockConf := Conf{ReloadCmd: "stop", VIPs: []string{"test"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy"}
@@ -82,12 +114,13 @@ func TestGetDefaults(t *testing.T) {
 
 	s := buildMockServer(false)
 	s.Start()
-	res, err := mockWatcher.getDefaultsConfig()
+	tree, err := mockWatcher.getKVTree()
 	if err != nil {
-		t.Errorf("TestGetDefaults failure: ", err)
+		t.Errorf("TestGetDefaults failure: %v", err)
 	}
-	if string(res) != string(success) {
-		t.Errorf("response is: \n %s \n should be: \n %s \n", string(res), string(success))
+	res := tree.get("defaults")
+	if res != string(success) {
+		t.Errorf("response is: \n %s \n should be: \n %s \n", res, string(success))
 	}
 	s.Close()
 }
@@ -99,7 +132,11 @@ func TestGetFrontendConf(t *testing.T) {
 
 	s := buildMockServer(false)
 	s.Start()
-	res := mockWatcher.getFrontendConf("test")
+	tree, err := mockWatcher.getKVTree()
+	if err != nil {
+		t.Errorf("TestFrontendConf failure: %v", err)
+	}
+	res := mockWatcher.getFrontendConf(tree, "test")
 	if res.BindOptions != "ssl crt /etc/ssl/private/layered.com.pem no-sslv3" {
 		t.Errorf("TestFrontendConf failure, BindOptions does not match")
 	}
@@ -125,7 +162,11 @@ func TestGetBackendConf(t *testing.T) {
 
 	s := buildMockServer(false)
 	s.Start()
-	res := mockWatcher.getBackendConf("test")
+	tree, err := mockWatcher.getKVTree()
+	if err != nil {
+		t.Errorf("TestBackendConf failure: %v", err)
+	}
+	res := mockWatcher.getBackendConf(tree, "test")
 	if res.BalanceType != "roundrobin" {
 		t.Errorf("TestBackendConf failure, BalanceType does not match")
 	}
@@ -176,6 +217,63 @@ func TestGetRestartCmd(t *testing.T) {
 	s.Close()
 }
 
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockConf := Conf{ConfigFile: filepath.Join(dir, "haproxy.cfg"), ValidateCmd: "grep -q backend {file}"}
+	mockWatcher := Watcher{Index: 0, Config: mockConf}
+	ioutil.WriteFile(mockWatcher.tempPath(), []byte("backend test-backend\n"), 0644)
+	if err := mockWatcher.validateConfig(); err != nil {
+		t.Errorf("TestValidateConfig rejected a valid config: %v", err)
+	}
+
+	mockWatcher.Config.ValidateCmd = "grep frontend {file}"
+	err = mockWatcher.validateConfig()
+	if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("TestValidateConfig expected a ValidationError, got: %v", err)
+	}
+
+	mockWatcher.Config.ValidateCmd = "none"
+	if err := mockWatcher.validateConfig(); err != nil {
+		t.Errorf("TestValidateConfig should skip validation with none: %v", err)
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	configFile, err := ioutil.TempFile("", "conf-builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configFile.Name())
+	configFile.WriteString("backend test-backend\n")
+	configFile.Close()
+	defer confText.Reset()
+
+	mockWatcher := Watcher{Index: 0, Config: Conf{ConfigFile: configFile.Name()}}
+	confText.Reset()
+	confText.WriteString("backend test-backend\n")
+	if mockWatcher.updateConfig() {
+		t.Errorf("TestUpdateConfig reported an identical config as changed")
+	}
+	if mockWatcher.skippedReloads != 1 {
+		t.Errorf("TestUpdateConfig skipped reloads is %d, should be 1", mockWatcher.skippedReloads)
+	}
+
+	confText.WriteString("backend test2-backend\n")
+	if !mockWatcher.updateConfig() {
+		t.Errorf("TestUpdateConfig missed a changed config")
+	}
+
+	mockWatcher.Config.ConfigFile = configFile.Name() + ".missing"
+	if !mockWatcher.updateConfig() {
+		t.Errorf("TestUpdateConfig should treat a missing config as changed")
+	}
+}
+
 func TestBuildConfigNoVIP(t *testing.T) {
 	global, _ := base64.StdEncoding.DecodeString("CWxvZyAvZGV2L2xvZwlsb2NhbDAKCWxvZyAvZGV2L2xvZwlsb2NhbDEgbm90aWNlCgljaHJvb3QgL3Zhci9saWIvaGFwcm94eQoJc3RhdHMgc29ja2V0IC92YXIvbGliL2hhcHJveHkvc3RhdHMgbW9kZSA3NzcgbGV2ZWwgb3BlcmF0b3IKCXN0YXRzIHRpbWVvdXQgMzBzCgl1c2VyIGhhcHJveHkKCWdyb3VwIGhhcHJveHkKCWRhZW1vbgogICAgICAgIGxvZyAxMC4xMDAuMTMyLjIyMyBsb2NhbDIKICAgICAgICBsb2ctc2VuZC1ob3N0bmFtZQoKCSMgRGVmYXVsdCBTU0wgbWF0ZXJpYWwgbG9jYXRpb25zCgljYS1iYXNlIC9ldGMvc3NsL2NlcnRzCgljcnQtYmFzZSAvZXRjL3NzbC9wcml2YXRlCgoJIyBEZWZhdWx0IGNpcGhlcnMgdG8gdXNlIG9uIFNTTC1lbmFibGVkIGxpc3RlbmluZyBzb2NrZXRzLgoJIyBGb3IgbW9yZSBpbmZvcm1hdGlvbiwgc2VlIGNpcGhlcnMoMVNTTCkuCglzc2wtZGVmYXVsdC1iaW5kLWNpcGhlcnMga0VFQ0RIK2FSU0ErQUVTOmtSU0ErQUVTOitBRVMyNTY6UkM0LVNIQToha0VESDohTE9XOiFFWFA6IU1ENTohYU5VTEw6IWVOVUxM")
 	defaults, _ := base64.StdEncoding.DecodeString("bG9nCWdsb2JhbAp0aW1lb3V0IGNvbm5lY3QgNTAwMAp0aW1lb3V0IGNsaWVudCAgNTAwMDAKdGltZW91dCBzZXJ2ZXIgIDUwMDAw")
@@ -306,143 +404,439 @@ server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.1
 	s.Close()
 }
 
-func buildMockServer(mockFail bool) httptest.Server {
-	// Hack for go 1.5 httptest.Server() race condition
-	// https://github.com/golang/go/issues/12262
-	time.Sleep(20 * time.Millisecond)
-	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/kv/apps/haproxy/global", handleProxyGlobal)
-	mux.HandleFunc("/v1/kv/apps/haproxy/defaults", handleProxyDefaults)
-	mux.HandleFunc("/v1/kv/apps/haproxy/frontend/test/bindOptions", handleFrontBindOpts)
-	mux.HandleFunc("/v1/kv/apps/haproxy/frontend/test/listenPort", handleFrontListenPort)
-	mux.HandleFunc("/v1/kv/apps/haproxy/frontend/test/mode", handleFrontMode)
-	mux.HandleFunc("/v1/kv/apps/haproxy/frontend/test/staticConf", handleFrontStaticConf)
-	mux.HandleFunc("/v1/kv/apps/haproxy/frontend/test2/bindOptions", handleFrontBindOpts)
-	mux.HandleFunc("/v1/kv/apps/haproxy/frontend/test2/listenPort", handleFrontListenPort)
-	mux.HandleFunc("/v1/kv/apps/haproxy/frontend/test2/mode", handleFrontMode)
-	mux.HandleFunc("/v1/kv/apps/haproxy/frontend/test2/staticConf", handleFrontStaticConf)
-	if !mockFail {
-		mux.HandleFunc("/v1/kv/apps/haproxy/frontend/", handleFront)
-	}
-
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test/balance", handleBackBalance)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test/catalogMapping", handleBackCatalogMapping)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test/mode", handleFrontMode)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test/staticConf", handleBackStaticConf)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test/type", handleBackType)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test2/balance", handleBackBalance)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test2/catalogMapping", handleBackCatalogMapping)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test2/mode", handleFrontMode)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test2/staticConf", handleBackStaticConf)
-	mux.HandleFunc("/v1/kv/apps/haproxy/backend/test2/type", handleBackType)
-	if !mockFail {
-		mux.HandleFunc("/v1/kv/apps/haproxy/backend/", handleBack)
-	}
-	mux.HandleFunc("/v1/catalog/service/test-staging", handleCatalogService)
-	l, err := net.Listen("tcp", "127.0.0.1:12424")
+func TestBuildConfigFrontendOnly(t *testing.T) {
+	mockConf := Conf{ReloadCmd: "stop", VIPs: []string{"test", "edge", "stats"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy"}
+	mockWatcher := Watcher{Config: mockConf}
 
-	if err != nil {
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
 
+	confText.Reset()
+	if err := mockWatcher.buildConfig(); err != nil {
+		t.Fatalf("TestBuildConfigFrontendOnly returned an error: %v", err)
 	}
-	testHTTPServer := httptest.Server{
-		Listener: l,
-		Config:   &http.Server{Handler: handlerAccessLog(mux)},
+	config := confText.String()
+	for _, section := range []string{
+		"frontend edge\nmode http\nbind 0.0.0.0:8443 \n\ndefault_backend test-backend\n\n",
+		"frontend stats\nmode http\nbind 0.0.0.0:9000 \n    stats enable\n\nfrontend test\n",
+		"default_backend test-backend\n\nbackend test-backend\n",
+	} {
+		if !strings.Contains(config, section) {
+			t.Errorf("TestBuildConfigFrontendOnly is missing %q:\n%s", section, config)
+		}
+	}
+	if strings.Contains(config, "edge-backend") || strings.Contains(config, "stats-backend") {
+		t.Errorf("TestBuildConfigFrontendOnly routes to a backend that does not exist:\n%s", config)
 	}
-	return testHTTPServer
 }
 
-func handleProxyGlobal(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `[{"CreateIndex":115762,"ModifyIndex":115762,"LockIndex":0,"Key":"apps/haproxy/global","Flags":0,"Value":"CWxvZyAvZGV2L2xvZwlsb2NhbDAKCWxvZyAvZGV2L2xvZwlsb2NhbDEgbm90aWNlCgljaHJvb3QgL3Zhci9saWIvaGFwcm94eQoJc3RhdHMgc29ja2V0IC92YXIvbGliL2hhcHJveHkvc3RhdHMgbW9kZSA3NzcgbGV2ZWwgb3BlcmF0b3IKCXN0YXRzIHRpbWVvdXQgMzBzCgl1c2VyIGhhcHJveHkKCWdyb3VwIGhhcHJveHkKCWRhZW1vbgogICAgICAgIGxvZyAxMC4xMDAuMTMyLjIyMyBsb2NhbDIKICAgICAgICBsb2ctc2VuZC1ob3N0bmFtZQoKCSMgRGVmYXVsdCBTU0wgbWF0ZXJpYWwgbG9jYXRpb25zCgljYS1iYXNlIC9ldGMvc3NsL2NlcnRzCgljcnQtYmFzZSAvZXRjL3NzbC9wcml2YXRlCgoJIyBEZWZhdWx0IGNpcGhlcnMgdG8gdXNlIG9uIFNTTC1lbmFibGVkIGxpc3RlbmluZyBzb2NrZXRzLgoJIyBGb3IgbW9yZSBpbmZvcm1hdGlvbiwgc2VlIGNpcGhlcnMoMVNTTCkuCglzc2wtZGVmYXVsdC1iaW5kLWNpcGhlcnMga0VFQ0RIK2FSU0ErQUVTOmtSU0ErQUVTOitBRVMyNTY6UkM0LVNIQToha0VESDohTE9XOiFFWFA6IU1ENTohYU5VTEw6IWVOVUxM"}]`
-	w.Write([]byte(body))
-}
+func TestBuildConfigListen(t *testing.T) {
+	mockConf := Conf{ReloadCmd: "stop", VIPs: []string{"pg"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy"}
+	mockWatcher := Watcher{Config: mockConf}
 
-func handleProxyDefaults(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `[{"CreateIndex":115760,"ModifyIndex":115760,"LockIndex":0,"Key":"apps/haproxy/defaults","Flags":0,"Value":"bG9nCWdsb2JhbAp0aW1lb3V0IGNvbm5lY3QgNTAwMAp0aW1lb3V0IGNsaWVudCAgNTAwMDAKdGltZW91dCBzZXJ2ZXIgIDUwMDAw"}]`
-	w.Write([]byte(body))
-}
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
 
-// call is sent with ?raw so we just return the raw text
-func handleFrontBindOpts(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `ssl crt /etc/ssl/private/layered.com.pem no-sslv3`
-	w.Write([]byte(body))
-}
+	confText.Reset()
+	if err := mockWatcher.buildConfig(); err != nil {
+		t.Fatalf("TestBuildConfigListen returned an error: %v", err)
+	}
+	listen := `listen pg
+mode tcp
+bind 0.0.0.0:5432
+balance leastconn
+    option tcp-check
+server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 10.109.192.82:8080 check
+server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check
+server warning-node 172.17.0.5:8080 check weight 10
 
-func handleFrontListenPort(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `443`
-	w.Write([]byte(body))
-}
+`
+	if !strings.Contains(confText.String(), listen) {
+		t.Errorf("TestBuildConfigListen got\n%s\nexpected a section like\n%s", confText.String(), listen)
+	}
+	if strings.Contains(confText.String(), "frontend pg") || strings.Contains(confText.String(), "backend pg") {
+		t.Errorf("TestBuildConfigListen rendered a frontend/backend for a listen VIP")
+	}
 
-func handleFrontMode(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `http`
-	w.Write([]byte(body))
+	// a listen section can not share its name with a frontend
+	tmpl, err := mockWatcher.loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := KVTree{"listen/clash/bind": ":80", "frontend/clash/listenPort": "80"}
+	if _, err := mockWatcher.buildVipConf(tree, tmpl, "clash", []string{"clash"}); err == nil {
+		t.Errorf("TestBuildConfigListen accepted a VIP with both listen and frontend sections")
+	}
 }
 
-func handleFrontStaticConf(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	w.Write([]byte(frontEndStaticBody))
+func TestDefaultBackendName(t *testing.T) {
+	tree := KVTree{"backend/api/mode": "http", "backend/admin/mode": "http", "frontend/edge/listenPort": "80"}
+	selected := []string{"web", "api", "edge"}
+	cases := []struct {
+		frontend   Frontend
+		hasBackend bool
+		expected   string
+	}{
+		{Frontend{}, true, "web-backend"},
+		{Frontend{}, false, ""},
+		{Frontend{DefaultBackend: "none"}, true, ""},
+		{Frontend{DefaultBackend: "api"}, true, "api-backend"},
+		{Frontend{DefaultBackend: "api"}, false, "api-backend"},
+	}
+	for _, c := range cases {
+		name, err := defaultBackendName(tree, "web", c.frontend, c.hasBackend, selected)
+		if err != nil || name != c.expected {
+			t.Errorf("TestDefaultBackendName %+v (backend %v) gave %q, %v, expected %q", c.frontend, c.hasBackend, name, err, c.expected)
+		}
+	}
+
+	// a frontend only VIP, a VIP missing from consul and one that is
+	// disabled or pinned elsewhere (so not selected) all have no backend here
+	for _, target := range []string{"edge", "missing", "admin"} {
+		if name, err := defaultBackendName(tree, "web", Frontend{DefaultBackend: target}, true, selected); err == nil {
+			t.Errorf("TestDefaultBackendName routing to %s gave %q, expected an error", target, name)
+		}
+	}
 }
 
-func handleFront(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `["apps/haproxy/frontend/test/","apps/haproxy/frontend/test2/"]`
-	w.Write([]byte(body))
+func TestBuildConfigDefaultBackendNotRendered(t *testing.T) {
+	// edge routes to test, which this host does not render
+	mockConf := Conf{ReloadCmd: "stop", VIPs: []string{"edge", "test2"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy"}
+	mockWatcher := Watcher{Config: mockConf}
+
+	s := buildMockServer(false)
+	s.Start()
+	defer s.Close()
+	defer confText.Reset()
+
+	confText.Reset()
+	if err := mockWatcher.buildConfig(); err != nil {
+		t.Fatalf("TestBuildConfigDefaultBackendNotRendered returned an error: %v", err)
+	}
+	if strings.Contains(confText.String(), "test-backend") {
+		t.Errorf("TestBuildConfigDefaultBackendNotRendered references a backend that is not rendered:\n%s", confText.String())
+	}
+	if !strings.Contains(confText.String(), "backend test2-backend") {
+		t.Errorf("TestBuildConfigDefaultBackendNotRendered dropped the other VIPs:\n%s", confText.String())
+	}
 }
 
-func handleBack(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `["apps/haproxy/backend/test/","apps/haproxy/backend/test2/"]`
-	w.Write([]byte(body))
+func TestGetBackendServers(t *testing.T) {
+	mockConf := Conf{ReloadCmd: "stop", VIPs: []string{"test"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy"}
+	mockWatcher := Watcher{Index: 0, Config: mockConf}
+
+	s := buildMockServer(false)
+	s.Start()
+	tests := []struct {
+		filter          string
+		disableCritical string
+		tags            string
+		addressSource   string
+		want            []string
+	}{
+		{"", "", "", "", []string{
+			"server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 10.109.192.82:8080 check",
+			"server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check",
+		}},
+		{"warning-ok", "", "", "", []string{
+			"server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 10.109.192.82:8080 check",
+			"server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check",
+			"server warning-node 172.17.0.5:8080 check weight 10",
+		}},
+		{"any", "", "", "", []string{
+			"server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 10.109.192.82:8080 check",
+			"server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check",
+			"server warning-node 172.17.0.5:8080 check weight 10",
+			"server critical-node 10.109.192.91:8080 check",
+		}},
+		{"warning-ok", "true", "", "", []string{
+			"server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 10.109.192.82:8080 check",
+			"server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check",
+			"server warning-node 172.17.0.5:8080 check weight 10",
+			"server critical-node 10.109.192.91:8080 check disabled",
+		}},
+		{"any", "", "blue", "", []string{
+			"server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 10.109.192.82:8080 check",
+			"server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check",
+			"server critical-node 10.109.192.91:8080 check",
+		}},
+		{"any", "", "blue, !canary", "", []string{
+			"server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 10.109.192.82:8080 check",
+			"server critical-node 10.109.192.91:8080 check",
+		}},
+		{"", "", "!blue", "", nil},
+		{"any", "", "blue,canary", "", []string{
+			"server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check",
+		}},
+		{"warning-ok", "", "", "node", []string{
+			"server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 10.109.192.82:8080 check",
+			"server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check",
+			"server warning-node 10.109.192.90:8080 check weight 10",
+		}},
+		{"", "", "", "wan", []string{
+			"server f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d 203.0.113.82:8080 check",
+			"server 22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d 10.109.192.76:8080 check",
+		}},
+	}
+	for _, test := range tests {
+		backend := Backend{CatalogMapping: "test-staging", ConfigType: "dynamic", HealthFilter: test.filter, DisableCritical: test.disableCritical, Tags: test.tags, AddressSource: test.addressSource}
+		servers, err := mockWatcher.getBackendServers(backend)
+		if err != nil {
+			t.Errorf("TestGetBackendServers(%q) returned an error: %v", test.filter, err)
+			continue
+		}
+		var got []string
+		for _, server := range servers {
+			got = append(got, server.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("TestGetBackendServers(%q, %q, %q, %q) results do not match", test.filter, test.disableCritical, test.tags, test.addressSource)
+			t.Errorf("GOT: %v", got)
+			t.Errorf("SHOULD BE: %v", test.want)
+		}
+	}
+
+	// service metadata overrides the backend defaults per instance
+	servers, err := mockWatcher.getBackendServers(Backend{CatalogMapping: "test-staging", ConfigType: "dynamic", HealthFilter: "warning-ok", DefaultWeight: "100"})
+	if err != nil {
+		t.Fatalf("TestGetBackendServers returned an error: %v", err)
+	}
+	weights := map[string]string{}
+	for _, server := range servers {
+		weights[server.Name] = server.Weight
+	}
+	if weights["warning-node"] != "10" || weights["22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d"] != "100" {
+		t.Errorf("TestGetBackendServers did not apply haproxy-weight from the service meta: %v", weights)
+	}
+
+	if _, err := mockWatcher.getBackendServers(Backend{CatalogMapping: "test-staging", HealthFilter: "bogus"}); err == nil {
+		t.Errorf("TestGetBackendServers expected an unknown healthFilter to be rejected")
+	}
+	if _, err := mockWatcher.getBackendServers(Backend{CatalogMapping: "test-staging", AddressSource: "bogus"}); err == nil {
+		t.Errorf("TestGetBackendServers expected an unknown addressSource to be rejected")
+	}
+	s.Close()
 }
 
-func handleBackBalance(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `roundrobin`
-	w.Write([]byte(body))
+func TestFetchIndex(t *testing.T) {
+	mockConf := Conf{ReloadCmd: "stop", VIPs: []string{"test"}, ConsulHostPort: "http://127.0.0.1:12424", ConsulConfigPath: "/apps/haproxy"}
+	mockWatcher := Watcher{Index: 0, Config: mockConf}
+
+	s := buildMockServer(false)
+	s.Start()
+	index, err := mockWatcher.fetchIndex(context.Background(), "/v1/catalog/services", 0)
+	if err != nil {
+		t.Errorf("TestFetchIndex returned an error: %v", err)
+	}
+	if index != 115780 {
+		t.Errorf("TestFetchIndex catalog index is %d, should be 115780", index)
+	}
+
+	if path := mockWatcher.kvTreePath(); path != "/v1/kv/apps/haproxy/?recurse" {
+		t.Errorf("TestFetchIndex kv watch path is %s, should not match sibling trees", path)
+	}
+	index, err = mockWatcher.fetchIndex(context.Background(), mockWatcher.kvTreePath(), 0)
+	if err != nil {
+		t.Errorf("TestFetchIndex returned an error: %v", err)
+	}
+	if index != 115762 {
+		t.Errorf("TestFetchIndex kv index is %d, should be 115762", index)
+	}
+	s.Close()
 }
-func handleBackCatalogMapping(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `test-staging`
-	w.Write([]byte(body))
+
+func TestWatchShutdown(t *testing.T) {
+	// consul that holds every blocking query open until it is abandoned
+	blocked := make(chan struct{}, 2)
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		blocked <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	mockConf := Conf{ReloadCmd: "true", VIPs: []string{"test"}, ConsulHostPort: s.URL, ConsulConfigPath: "/apps/haproxy"}
+	mockWatcher := &Watcher{Config: mockConf, ErrorChan: make(chan error, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		mockWatcher.Watch(ctx)
+		close(done)
+	}()
+
+	<-blocked
+	<-blocked
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("TestWatchShutdown Watch did not return after cancel")
+	}
+	if len(mockWatcher.ErrorChan) != 0 {
+		t.Errorf("TestWatchShutdown reported an error for the abandoned queries: %v", <-mockWatcher.ErrorChan)
+	}
 }
-func handleBackStaticConf(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	w.Write([]byte(backEndStaticBody))
+
+func buildMockServer(mockFail bool) *httptest.Server {
+	// Hack for go 1.5 httptest.Server() race condition
+	// https://github.com/golang/go/issues/12262
+	time.Sleep(20 * time.Millisecond)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/health/service/test-staging", handleHealthService)
+	mux.HandleFunc("/v1/catalog/services", handleCatalogServices)
+	mux.HandleFunc("/v1/kv/", handleKVTree(mockFail))
+	l, err := net.Listen("tcp", "127.0.0.1:12424")
+
+	if err != nil {
+
+	}
+	testHTTPServer := &httptest.Server{
+		Listener: l,
+		Config:   &http.Server{Handler: handlerAccessLog(mux)},
+	}
+	return testHTTPServer
 }
-func handleBackType(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `dynamic`
-	w.Write([]byte(body))
+
+var globalValue = "CWxvZyAvZGV2L2xvZwlsb2NhbDAKCWxvZyAvZGV2L2xvZwlsb2NhbDEgbm90aWNlCgljaHJvb3QgL3Zhci9saWIvaGFwcm94eQoJc3RhdHMgc29ja2V0IC92YXIvbGliL2hhcHJveHkvc3RhdHMgbW9kZSA3NzcgbGV2ZWwgb3BlcmF0b3IKCXN0YXRzIHRpbWVvdXQgMzBzCgl1c2VyIGhhcHJveHkKCWdyb3VwIGhhcHJveHkKCWRhZW1vbgogICAgICAgIGxvZyAxMC4xMDAuMTMyLjIyMyBsb2NhbDIKICAgICAgICBsb2ctc2VuZC1ob3N0bmFtZQoKCSMgRGVmYXVsdCBTU0wgbWF0ZXJpYWwgbG9jYXRpb25zCgljYS1iYXNlIC9ldGMvc3NsL2NlcnRzCgljcnQtYmFzZSAvZXRjL3NzbC9wcml2YXRlCgoJIyBEZWZhdWx0IGNpcGhlcnMgdG8gdXNlIG9uIFNTTC1lbmFibGVkIGxpc3RlbmluZyBzb2NrZXRzLgoJIyBGb3IgbW9yZSBpbmZvcm1hdGlvbiwgc2VlIGNpcGhlcnMoMVNTTCkuCglzc2wtZGVmYXVsdC1iaW5kLWNpcGhlcnMga0VFQ0RIK2FSU0ErQUVTOmtSU0ErQUVTOitBRVMyNTY6UkM0LVNIQToha0VESDohTE9XOiFFWFA6IU1ENTohYU5VTEw6IWVOVUxM"
+
+var defaultsValue = "bG9nCWdsb2JhbAp0aW1lb3V0IGNvbm5lY3QgNTAwMAp0aW1lb3V0IGNsaWVudCAgNTAwMDAKdGltZW91dCBzZXJ2ZXIgIDUwMDAw"
+
+// mockKV returns the raw values served for the apps/haproxy tree, keyed
+// relative to it. When mockFail is set only global and defaults exist.
+func mockKV(mockFail bool) map[string]string {
+	global, _ := base64.StdEncoding.DecodeString(globalValue)
+	defaults, _ := base64.StdEncoding.DecodeString(defaultsValue)
+	kv := map[string]string{
+		"":         "",
+		"global":   string(global),
+		"defaults": string(defaults),
+	}
+	if mockFail {
+		return kv
+	}
+	for _, vip := range []string{"test", "test2"} {
+		kv["frontend/"+vip+"/bindOptions"] = "ssl crt /etc/ssl/private/layered.com.pem no-sslv3"
+		kv["frontend/"+vip+"/listenPort"] = "443"
+		kv["frontend/"+vip+"/mode"] = "http"
+		kv["frontend/"+vip+"/staticConf"] = frontEndStaticBody
+		kv["backend/"+vip+"/balance"] = "roundrobin"
+		kv["backend/"+vip+"/catalogMapping"] = "test-staging"
+		kv["backend/"+vip+"/mode"] = "http"
+		kv["backend/"+vip+"/staticConf"] = backEndStaticBody
+		kv["backend/"+vip+"/type"] = "dynamic"
+	}
+	// frontend only VIPs, one routing to the test backend
+	kv["frontend/edge/listenPort"] = "8443"
+	kv["frontend/edge/mode"] = "http"
+	kv["frontend/edge/defaultBackend"] = "test"
+	kv["frontend/stats/listenPort"] = "9000"
+	kv["frontend/stats/mode"] = "http"
+	kv["frontend/stats/staticConf"] = "    stats enable"
+	// a frontend only VIP pinned to one HAProxy node
+	kv["frontend/admin/listenPort"] = "9001"
+	kv["frontend/admin/mode"] = "http"
+	kv["vip/admin/nodes"] = "lb-1"
+	// a single listen section
+	kv["listen/pg/bind"] = "0.0.0.0:5432"
+	kv["listen/pg/mode"] = "tcp"
+	kv["listen/pg/balance"] = "leastconn"
+	kv["listen/pg/catalogMapping"] = "test-staging"
+	kv["listen/pg/staticConf"] = "    option tcp-check"
+	kv["listen/pg/type"] = "dynamic"
+	kv["listen/pg/healthFilter"] = "warning-ok"
+	return kv
 }
-func handleCatalogService(w http.ResponseWriter, r *http.Request) {
-	writeHeaders(w, 200)
-	body := `[
+
+var healthServiceBody = `[
+  {
+    "Node": {"Node": "f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d", "Address": "10.109.192.82", "TaggedAddresses": {"lan": "10.109.192.82", "wan": "203.0.113.82"}},
+    "Service": {"ID": "f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d", "Service": "test-staging", "Tags": ["blue"], "Address": "10.109.192.82", "Port": 8080},
+    "Checks": [{"CheckID": "serfHealth", "Status": "passing"}, {"CheckID": "service:test-staging", "Status": "passing"}]
+  },
+  {
+    "Node": {"Node": "22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d", "Address": "10.109.192.76"},
+    "Service": {"ID": "22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d", "Service": "test-staging", "Tags": ["blue", "canary"], "Address": "10.109.192.76", "Port": 8080},
+    "Checks": [{"CheckID": "serfHealth", "Status": "passing"}, {"CheckID": "service:test-staging", "Status": "passing"}]
+  },
   {
-    "Node": "f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d",
-    "Address": "10.109.192.82",
-    "ServiceID": "f52104961dc6726a65b4b100e9c3f57c3b0060f97a4654b2eee9b2b8ceb00e1d",
-    "ServiceName": "test-staging",
-    "ServiceTags": [],
-    "ServiceAddress": "10.109.192.82",
-    "ServicePort": 8080
+    "Node": {"Node": "warning-node", "Address": "10.109.192.90"},
+    "Service": {"ID": "warning-node", "Service": "test-staging", "Tags": ["green"], "Address": "172.17.0.5", "Port": 8080, "Meta": {"haproxy-weight": "10"}},
+    "Checks": [{"CheckID": "serfHealth", "Status": "passing"}, {"CheckID": "service:test-staging", "Status": "warning"}]
   },
   {
-    "Node": "22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d",
-    "Address": "10.109.192.76",
-    "ServiceID": "22c8fe2e391327e0380474c608841783863160cdad50ddc174490688f588537d",
-    "ServiceName": "test-staging",
-    "ServiceTags": [],
-    "ServiceAddress": "10.109.192.76",
-    "ServicePort": 8080
+    "Node": {"Node": "critical-node", "Address": "10.109.192.91"},
+    "Service": {"ID": "critical-node", "Service": "test-staging", "Tags": ["blue"], "Address": "10.109.192.91", "Port": 8080},
+    "Checks": [{"CheckID": "serfHealth", "Status": "passing"}, {"CheckID": "service:test-staging", "Status": "critical"}]
   }
 ]`
+
+// handleHealthService mimics /v1/health/service/<name>, dropping anything
+// that is not passing when ?passing is set or lacks the ?tag.
+func handleHealthService(w http.ResponseWriter, r *http.Request) {
+	writeHeaders(w, 200)
+	var entries []ConsulHealthEntry
+	json.Unmarshal([]byte(healthServiceBody), &entries)
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		var tagged []ConsulHealthEntry
+		for _, entry := range entries {
+			if contains(entry.Service.Tags, tag) {
+				tagged = append(tagged, entry)
+			}
+		}
+		entries = tagged
+	}
+	if _, ok := r.URL.Query()["passing"]; ok {
+		var passing []ConsulHealthEntry
+		for _, entry := range entries {
+			if healthStatus(entry.Checks) == healthPassing {
+				passing = append(passing, entry)
+			}
+		}
+		entries = passing
+	}
+	body, _ := json.Marshal(entries)
+	w.Write(body)
+}
+
+func handleCatalogServices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("X-Consul-Index", "115780")
+	writeHeaders(w, 200)
+	body := `{"consul":[],"test-staging":[]}`
 	w.Write([]byte(body))
 }
 
+// handleKVTree serves the apps/haproxy tree next to an apps/haproxy-staging
+// one, matching keys on a plain prefix like consul's recurse does.
+func handleKVTree(mockFail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Consul-Index", "115762")
+		writeHeaders(w, 200)
+		kv := make(map[string]string)
+		for key, value := range mockKV(mockFail) {
+			kv["apps/haproxy/"+key] = value
+			kv["apps/haproxy-staging/"+key] = value
+		}
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		var entries []ConsulEntry
+		for key, value := range kv {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			entries = append(entries, ConsulEntry{
+				CreateIndex: 115760,
+				ModifyIndex: 115762,
+				Key:         key,
+				Value:       base64.StdEncoding.EncodeToString([]byte(value)),
+			})
+		}
+		body, _ := json.Marshal(entries)
+		w.Write(body)
+	}
+}
+
 func writeHeaders(w http.ResponseWriter, code int) {
 	h := w.Header()
 	h.Add("Content-Type", "application/json")